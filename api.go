@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/cyverse-de/group-propagator/broker"
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+// API serves the administrative HTTP endpoints:
+//
+//	GET  /groups              list the propagation state of every group in every target
+//	GET  /groups/<id>         show the propagation state of one group
+//	GET  /held                list changes held for review in every target
+//	GET  /held/<id>           show the held change for a group
+//	POST /held/<id>/approve   apply the held change for a group
+//	POST /held/<id>/reject    discard the held change for a group
+//
+// POST requests need the configured token as a bearer token, or without one,
+// must come from the same host.
+//
+//	GET  /config              show the version of the configuration in effect
+//	GET  /metrics             report the configuration version in Prometheus' text format
+//	GET  /healthz             show the AMQP connection state; 503 while disconnected
+//	GET  /crawls              list the progress of crawls this instance started
+//	GET  /crawls/<id>         show the progress of one crawl
+//
+// Endpoints for a single group take a target query parameter, defaulting to
+// the first configured target.
+type API struct {
+	propagator *Propagator
+	stateStore store.Store
+	broker     *broker.Broker
+	crawls     *crawlTracker
+	token      string
+}
+
+func NewAPI(propagator *Propagator, stateStore store.Store, broker *broker.Broker, crawls *crawlTracker, token string) *API {
+	return &API{
+		propagator: propagator,
+		stateStore: stateStore,
+		broker:     broker,
+		crawls:     crawls,
+		token:      token,
+	}
+}
+
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/groups", a.listGroups)
+	mux.HandleFunc("/groups/", a.getGroup)
+	mux.HandleFunc("/held", a.listHeld)
+	mux.HandleFunc("/held/", a.heldChange)
+	mux.HandleFunc("/config", a.getConfig)
+	mux.HandleFunc("/metrics", a.metrics)
+	mux.HandleFunc("/healthz", a.health)
+	mux.HandleFunc("/crawls", a.listCrawls)
+	mux.HandleFunc("/crawls/", a.getCrawl)
+	return otelhttp.NewHandler(mux, serviceName)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(errors.Wrap(err, "Failed encoding response"))
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := restutils.GetStatusCode(err)
+	if status >= 500 {
+		log.Error(err)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// The target named by a request, or the default target.
+func (a *API) requestTarget(r *http.Request) string {
+	if target := r.URL.Query().Get("target"); target != "" {
+		return target
+	}
+	return a.propagator.DefaultTarget()
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeError(w, restutils.NewHTTPError(http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path))
+		return false
+	}
+	return true
+}
+
+// Check that a request may change things: that it has the token, or without
+// one, that it comes from the same host.
+func (a *API) requireAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if a.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+			return true
+		}
+		writeError(w, restutils.NewHTTPError(http.StatusUnauthorized, "A valid bearer token is required for "+r.URL.Path))
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return true
+	}
+	writeError(w, restutils.NewHTTPError(http.StatusForbidden, "Without api.token set, "+r.URL.Path+" can only be used from the same host"))
+	return false
+}
+
+func (a *API) listGroups(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	states, err := a.stateStore.ListGroupStates()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"groups": states})
+}
+
+func (a *API) getGroup(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	groupID := strings.TrimPrefix(r.URL.Path, "/groups/")
+	target := a.requestTarget(r)
+	state, err := a.stateStore.GetGroupState(target, groupID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if state == nil {
+		writeError(w, restutils.NewHTTPError(http.StatusNotFound, "No state is recorded for group "+groupID+" in "+target))
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (a *API) listHeld(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	changes, err := a.stateStore.ListHeldChanges()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"held": changes})
+}
+
+// Handles /held/<id>, /held/<id>/approve and /held/<id>/reject.
+func (a *API) heldChange(w http.ResponseWriter, r *http.Request) {
+	groupID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/held/"), "/")
+	target := a.requestTarget(r)
+
+	var (
+		change *store.HeldChange
+		err    error
+	)
+
+	switch action {
+	case "":
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		change, err = a.propagator.getHeldChange(target, groupID)
+	case "approve":
+		if !requireMethod(w, r, http.MethodPost) || !a.requireAuthorized(w, r) {
+			return
+		}
+		change, err = a.propagator.ApplyHeldChange(r.Context(), target, groupID)
+	case "reject":
+		if !requireMethod(w, r, http.MethodPost) || !a.requireAuthorized(w, r) {
+			return
+		}
+		change, err = a.propagator.RejectHeldChange(target, groupID)
+	default:
+		err = restutils.NewHTTPError(http.StatusNotFound, "Unknown action "+action)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+func (a *API) getConfig(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	rules := a.propagator.current()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":         rules.Version,
+		"loaded_at":       rules.LoadedAt,
+		"restart_pending": rules.RestartPending,
+	})
+}
+
+func (a *API) metrics(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	rules := a.propagator.current()
+	restartPending := 0
+	if rules.RestartPending {
+		restartPending = 1
+	}
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, `# HELP group_propagator_config_info The version of the configuration in effect.
+# TYPE group_propagator_config_info gauge
+group_propagator_config_info{version=%q} 1
+# HELP group_propagator_config_loaded_timestamp_seconds When the configuration in effect was loaded.
+# TYPE group_propagator_config_loaded_timestamp_seconds gauge
+group_propagator_config_loaded_timestamp_seconds %d
+# HELP group_propagator_config_restart_pending Whether the configuration changes settings that need a restart.
+# TYPE group_propagator_config_restart_pending gauge
+group_propagator_config_restart_pending %d
+`, rules.Version, rules.LoadedAt.Unix(), restartPending)
+}
+
+func (a *API) health(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	status := a.broker.Status()
+	if !status.Connected {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (a *API) listCrawls(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"crawls": a.crawls.list()})
+}
+
+func (a *API) getCrawl(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	progress, err := a.crawls.get(strings.TrimPrefix(r.URL.Path, "/crawls/"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, progress)
+}
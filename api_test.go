@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequireAuthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		header     string
+		status     int
+	}{
+		{"no token, same host", "", "127.0.0.1:5000", "", http.StatusOK},
+		{"no token, same host over IPv6", "", "[::1]:5000", "", http.StatusOK},
+		{"no token, other host", "", "10.0.0.5:5000", "", http.StatusForbidden},
+		{"token", "secret", "10.0.0.5:5000", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", "10.0.0.5:5000", "Bearer guess", http.StatusUnauthorized},
+		{"token without the scheme", "secret", "10.0.0.5:5000", "secret", http.StatusUnauthorized},
+		{"token required even from the same host", "secret", "127.0.0.1:5000", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &API{token: tt.token}
+
+			r := httptest.NewRequest(http.MethodPost, "/held/abc/approve", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			if a.requireAuthorized(w, r) {
+				w.WriteHeader(http.StatusOK)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rules := &atomic.Pointer[Rules]{}
+	rules.Store(&Rules{Version: "0123abcd", LoadedAt: time.Unix(1700000000, 0), RestartPending: true})
+	a := &API{propagator: &Propagator{rules: rules}}
+
+	w := httptest.NewRecorder()
+	a.metrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, line := range []string{
+		`group_propagator_config_info{version="0123abcd"} 1`,
+		`group_propagator_config_loaded_timestamp_seconds 1700000000`,
+		`group_propagator_config_restart_pending 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics are missing %s:\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Package broker keeps a connection to an AMQP broker open, reconnecting with
+// backoff when it drops and re-declaring the exchange, queue and bindings each
+// time, so consumers and publishers survive broker restarts.
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cyverse-de/group-propagator/logging"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "broker"})
+
+const otelName = "github.com/cyverse-de/group-propagator/broker"
+
+// The bounds on how long to wait between connection attempts.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// How long publishing waits for a lost connection to come back.
+const publishWait = 30 * time.Second
+
+// Handler handles a delivery, and must ack, nack or reject it.
+type Handler func(ctx context.Context, del amqp.Delivery)
+
+// Consumer describes a queue to declare, bind and consume from.
+type Consumer struct {
+	Exchange     string
+	ExchangeType string
+	Queue        string
+	Keys         []string
+	Prefetch     int
+	Handler      Handler
+
+	// Arguments to declare the queue with, such as x-max-priority.
+	Args amqp.Table
+
+	// Whether the queue is only for this connection, and deleted with it.
+	Exclusive bool
+}
+
+// Status describes the state of the connection, for health reporting.
+type Status struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// How many times the connection has been re-established.
+	Reconnects int `json:"reconnects"`
+}
+
+type Broker struct {
+	uri      string
+	exchange string
+
+	// Set before Run, and re-established on every connection.
+	consumers []Consumer
+
+	mu        sync.Mutex
+	status    Status
+	publisher *amqp.Channel
+	consumer  *amqp.Channel
+	consuming bool
+
+	// Whether a connection has ever been made, so the first isn't counted as a reconnect.
+	everConnected bool
+
+	// Closed and replaced whenever the connection is established.
+	connected chan struct{}
+}
+
+// New returns a broker that publishes to the given exchange. Nothing connects until Run.
+func New(uri, exchange string) *Broker {
+	return &Broker{
+		uri:       uri,
+		exchange:  exchange,
+		consuming: true,
+		status:    Status{Since: time.Now()},
+		connected: make(chan struct{}),
+	}
+}
+
+// AddConsumer registers a consumer. It must be called before Run.
+func (b *Broker) AddConsumer(c Consumer) {
+	b.consumers = append(b.consumers, c)
+}
+
+func (b *Broker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// Run connects and stays connected until the context is cancelled.
+func (b *Broker) Run(ctx context.Context) {
+	backoff := minBackoff
+
+	for ctx.Err() == nil {
+		conn, lost, err := b.connect()
+		if err != nil {
+			b.setDisconnected(err)
+			log.Error(errors.Wrapf(err, "Failed connecting to the AMQP broker, retrying in %s", backoff))
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+
+		select {
+		case <-ctx.Done():
+			b.setDisconnected(nil)
+			conn.Close()
+			return
+		case err = <-lost:
+			// Start over on a new connection, even if only a channel was lost.
+			b.setDisconnected(err)
+			conn.Close()
+			log.Error(errors.Wrap(err, "Lost the connection to the AMQP broker, reconnecting"))
+		}
+	}
+}
+
+// Watch for the connection or either channel closing, or the broker
+// cancelling a consumer, such as when its queue is deleted. Any of them
+// leaves the service unable to publish or consume, so the returned channel
+// receives the first. The notifications must be registered before consumers
+// start, so that none are missed.
+func (b *Broker) watch(conn *amqp.Connection, publisher, consumer *amqp.Channel) <-chan error {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	publisherClosed := publisher.NotifyClose(make(chan *amqp.Error, 1))
+	consumerClosed := consumer.NotifyClose(make(chan *amqp.Error, 1))
+
+	// The library blocks sending cancellations, so there's room for every
+	// consumer to be cancelled even after the first ends the watch.
+	publisherCancelled := publisher.NotifyCancel(make(chan string, 1))
+	consumerCancelled := consumer.NotifyCancel(make(chan string, len(b.consumers)+1))
+
+	// A nil error means the connection or channel was closed on purpose.
+	closeErr := func(what string, amqpErr *amqp.Error) error {
+		if amqpErr != nil {
+			return errors.Wrapf(amqpErr, "%s closed", what)
+		}
+		return errors.Errorf("%s closed", what)
+	}
+
+	lost := make(chan error, 1)
+	go func() {
+		var err error
+		select {
+		case amqpErr := <-connClosed:
+			err = closeErr("connection", amqpErr)
+		case amqpErr := <-publisherClosed:
+			err = closeErr("publishing channel", amqpErr)
+		case amqpErr := <-consumerClosed:
+			err = closeErr("consumer channel", amqpErr)
+		case tag := <-publisherCancelled:
+			err = errors.Errorf("the broker cancelled consumer %s", tag)
+		case tag := <-consumerCancelled:
+			err = errors.Errorf("the broker cancelled consumer %s", tag)
+		}
+		lost <- err
+	}()
+	return lost
+}
+
+func (b *Broker) setDisconnected(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.status.Connected {
+		b.status.Connected = false
+		b.status.Since = time.Now()
+		b.connected = make(chan struct{})
+	}
+	b.publisher = nil
+	b.consumer = nil
+	if err != nil {
+		b.status.LastError = err.Error()
+	}
+}
+
+// Dial the broker and set up publishing and every consumer on the new
+// connection. The returned channel receives an error once it's lost.
+func (b *Broker) connect() (*amqp.Connection, <-chan error, error) {
+	conn, err := amqp.Dial(b.uri)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publisher, err := conn.Channel()
+	if err == nil {
+		err = publisher.ExchangeDeclare(b.exchange, "topic", true, false, false, false, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "Failed setting up publishing")
+	}
+
+	consumer, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "Failed opening a channel for consumers")
+	}
+
+	lost := b.watch(conn, publisher, consumer)
+
+	b.mu.Lock()
+	consuming := b.consuming
+	b.mu.Unlock()
+
+	if consuming {
+		for _, c := range b.consumers {
+			if err = b.startConsumer(consumer, c); err != nil {
+				conn.Close()
+				return nil, nil, errors.Wrapf(err, "Failed setting up the consumer for %s", c.Queue)
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.status.Connected {
+		if b.everConnected {
+			b.status.Reconnects++
+		}
+		b.everConnected = true
+		b.status.Connected = true
+		b.status.Since = time.Now()
+		close(b.connected)
+	}
+	b.publisher = publisher
+	b.consumer = consumer
+
+	log.Info("Connected to the AMQP broker")
+	return conn, lost, nil
+}
+
+// Declare a consumer's exchange, queue and bindings, then deliver its
+// messages to its handler, each in its own goroutine.
+func (b *Broker) startConsumer(ch *amqp.Channel, c Consumer) error {
+	if c.Prefetch > 0 {
+		if err := ch.Qos(c.Prefetch, 0, false); err != nil {
+			return errors.Wrap(err, "Failed setting the prefetch count")
+		}
+	}
+	if err := ch.ExchangeDeclare(c.Exchange, c.ExchangeType, true, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "Failed declaring exchange %s", c.Exchange)
+	}
+	if _, err := ch.QueueDeclare(c.Queue, !c.Exclusive, c.Exclusive, c.Exclusive, false, c.Args); err != nil {
+		return errors.Wrapf(err, "Failed declaring queue %s", c.Queue)
+	}
+	for _, key := range c.Keys {
+		if err := ch.QueueBind(c.Queue, key, c.Exchange, false, nil); err != nil {
+			return errors.Wrapf(err, "Failed binding %s to queue %s", key, c.Queue)
+		}
+	}
+
+	deliveries, err := ch.Consume(c.Queue, c.Queue, false, false, false, false, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Failed consuming from queue %s", c.Queue)
+	}
+
+	go func() {
+		for del := range deliveries {
+			go b.handle(c, del)
+		}
+	}()
+	return nil
+}
+
+func (b *Broker) handle(c Consumer, del amqp.Delivery) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), messaging.AMQPHeaderCarrier(del.Headers))
+	ctx, span := otel.Tracer(otelName).Start(ctx, c.Queue+" process", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.rabbitmq.routing_key", del.RoutingKey),
+		attribute.String("messaging.destination", del.Exchange),
+	)
+
+	c.Handler(ctx, del)
+}
+
+// StopConsuming cancels every consumer, such as when shutting down. Messages
+// already delivered are still handled.
+func (b *Broker) StopConsuming() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consuming = false
+	if b.consumer == nil {
+		return
+	}
+	for _, c := range b.consumers {
+		if err := b.consumer.Cancel(c.Queue, false); err != nil {
+			log.Error(errors.Wrapf(err, "Failed cancelling the consumer for %s", c.Queue))
+		}
+	}
+}
+
+// Wait until connected to publish, so that a brief outage doesn't fail
+// everything being published.
+func (b *Broker) publishChannel(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		b.mu.Lock()
+		ch, connected := b.publisher, b.connected
+		b.mu.Unlock()
+
+		if ch != nil {
+			return ch, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "Not connected to the AMQP broker")
+		case <-connected:
+		}
+	}
+}
+
+// PublishingOpts are the properties of a published message.
+type PublishingOpts struct {
+	ContentType string
+	Priority    uint8
+}
+
+// DefaultPublishingOpts are used for messages whose bodies are plain text.
+var DefaultPublishingOpts = PublishingOpts{ContentType: "text/plain"}
+
+// PublishContext sends a message to the exchange with the default options.
+func (b *Broker) PublishContext(ctx context.Context, key string, body []byte) error {
+	return b.PublishOpts(ctx, key, body, DefaultPublishingOpts)
+}
+
+// PublishOpts sends a message to the exchange, waiting a while for the
+// connection if it's down.
+func (b *Broker) PublishOpts(ctx context.Context, key string, body []byte, opts PublishingOpts) error {
+	ctx, span := otel.Tracer(otelName).Start(ctx, b.exchange+" send", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.rabbitmq.routing_key", key),
+		attribute.String("messaging.destination", b.exchange),
+	)
+
+	headers := make(amqp.Table)
+	otel.GetTextMapPropagator().Inject(ctx, messaging.AMQPHeaderCarrier(headers))
+
+	waitCtx, cancel := context.WithTimeout(ctx, publishWait)
+	defer cancel()
+
+	ch, err := b.publishChannel(waitCtx)
+	if err == nil {
+		err = ch.Publish(b.exchange, key, false, false, amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			ContentType:  opts.ContentType,
+			Priority:     opts.Priority,
+			Body:         body,
+			Headers:      headers,
+		})
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed publishing message")
+		return errors.Wrapf(err, "Failed publishing %s", key)
+	}
+	return nil
+}
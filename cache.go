@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a crawl's cache entries are kept after the last group it requested
+// was propagated, for crawls whose end this instance doesn't see, such as
+// those started by other instances.
+const crawlCacheIdle = 10 * time.Minute
+
+type memberCacheEntry struct {
+	groupID string
+	members []string
+
+	// The IDs of every group nested within this one, at any depth.
+	nested  []string
+	expires time.Time
+}
+
+// The cache entries for one crawl, or for propagations outside any crawl.
+type memberCacheScope struct {
+	entries  map[string]memberCacheEntry
+	lastUsed time.Time
+}
+
+// memberCache holds expanded memberships of Grouper groups nested in other
+// groups, keyed by group name, so that popular subgroups aren't fetched again
+// for every group that includes them. Each crawl has entries of its own,
+// dropped when it ends or goes idle, so that a crawl never sees expansions
+// from before it started. Outside crawls, entries are only kept if there's a
+// TTL. Entries are also dropped when a group they depend on is propagated.
+type memberCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+
+	// Keyed by crawl ID, with propagations outside crawls under the empty ID.
+	scopes map[string]*memberCacheScope
+}
+
+// newMemberCache returns an empty cache. A ttl of zero caches nothing outside crawls.
+func newMemberCache(ttl time.Duration) *memberCache {
+	return &memberCache{
+		ttl:    ttl,
+		scopes: make(map[string]*memberCacheScope),
+	}
+}
+
+// Get the entries for a crawl, or for propagations outside crawls, dropping
+// those of crawls that have gone idle. Returns nil if nothing is cached
+// outside crawls.
+func (c *memberCache) scope(crawlID string) *memberCacheScope {
+	now := time.Now()
+	for id, s := range c.scopes {
+		if id != "" && now.Sub(s.lastUsed) > crawlCacheIdle {
+			delete(c.scopes, id)
+		}
+	}
+
+	if crawlID == "" && c.ttl == 0 {
+		return nil
+	}
+
+	s, ok := c.scopes[crawlID]
+	if !ok {
+		s = &memberCacheScope{entries: make(map[string]memberCacheEntry)}
+		c.scopes[crawlID] = s
+	}
+	s.lastUsed = now
+	return s
+}
+
+func (c *memberCache) get(crawlID, groupName string) (memberCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var e memberCacheEntry
+	s := c.scope(crawlID)
+	if s == nil {
+		return e, false
+	}
+
+	e, ok := s.entries[groupName]
+	if !ok {
+		return e, false
+	}
+	if crawlID == "" && time.Now().After(e.expires) {
+		delete(s.entries, groupName)
+		return e, false
+	}
+	return e, true
+}
+
+func (c *memberCache) put(crawlID, groupName, groupID string, members, nested []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.scope(crawlID)
+	if s == nil {
+		return
+	}
+
+	s.entries[groupName] = memberCacheEntry{
+		groupID: groupID,
+		members: members,
+		nested:  nested,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate drops the entries for a group along with any entries for groups
+// that have it nested within them, in every crawl.
+func (c *memberCache) invalidate(groupID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range c.scopes {
+		for name, e := range s.entries {
+			if e.groupID == groupID {
+				delete(s.entries, name)
+				continue
+			}
+			for _, n := range e.nested {
+				if n == groupID {
+					delete(s.entries, name)
+					break
+				}
+			}
+		}
+	}
+}
+
+// endCrawl drops a crawl's entries once it's done.
+func (c *memberCache) endCrawl(crawlID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.scopes, crawlID)
+}
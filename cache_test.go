@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberCacheScopes(t *testing.T) {
+	c := newMemberCache(0)
+
+	c.put("", "iplant:de:prod:sub", "sub", []string{"alice"}, nil)
+	if _, ok := c.get("", "iplant:de:prod:sub"); ok {
+		t.Error("cached outside a crawl without a TTL")
+	}
+
+	c.put("c1", "iplant:de:prod:sub", "sub", []string{"alice"}, nil)
+	if e, ok := c.get("c1", "iplant:de:prod:sub"); !ok || len(e.members) != 1 || e.members[0] != "alice" {
+		t.Errorf("get in the crawl = %+v, %t, want alice", e, ok)
+	}
+	if _, ok := c.get("c2", "iplant:de:prod:sub"); ok {
+		t.Error("another crawl saw the first crawl's entry")
+	}
+	if _, ok := c.get("", "iplant:de:prod:sub"); ok {
+		t.Error("a propagation outside crawls saw a crawl's entry")
+	}
+
+	c.endCrawl("c1")
+	if _, ok := c.get("c1", "iplant:de:prod:sub"); ok {
+		t.Error("entry survived the end of its crawl")
+	}
+}
+
+func TestMemberCacheTTL(t *testing.T) {
+	c := newMemberCache(time.Minute)
+
+	c.put("", "iplant:de:prod:sub", "sub", []string{"alice"}, nil)
+	if _, ok := c.get("", "iplant:de:prod:sub"); !ok {
+		t.Fatal("not cached outside a crawl with a TTL")
+	}
+
+	c.mu.Lock()
+	e := c.scopes[""].entries["iplant:de:prod:sub"]
+	e.expires = time.Now().Add(-time.Second)
+	c.scopes[""].entries["iplant:de:prod:sub"] = e
+	c.mu.Unlock()
+
+	if _, ok := c.get("", "iplant:de:prod:sub"); ok {
+		t.Error("expired entry was returned")
+	}
+
+	// Crawl entries last as long as the crawl, whatever the TTL.
+	c.put("c1", "iplant:de:prod:sub", "sub", []string{"alice"}, nil)
+	c.mu.Lock()
+	e = c.scopes["c1"].entries["iplant:de:prod:sub"]
+	e.expires = time.Now().Add(-time.Second)
+	c.scopes["c1"].entries["iplant:de:prod:sub"] = e
+	c.mu.Unlock()
+
+	if _, ok := c.get("c1", "iplant:de:prod:sub"); !ok {
+		t.Error("crawl entry expired with the TTL")
+	}
+}
+
+func TestMemberCacheIdleCrawls(t *testing.T) {
+	c := newMemberCache(0)
+
+	c.put("c1", "iplant:de:prod:sub", "sub", []string{"alice"}, nil)
+	c.mu.Lock()
+	c.scopes["c1"].lastUsed = time.Now().Add(-crawlCacheIdle - time.Second)
+	c.mu.Unlock()
+
+	if _, ok := c.get("c2", "iplant:de:prod:other"); ok {
+		t.Fatal("unexpected entry")
+	}
+	c.mu.Lock()
+	_, kept := c.scopes["c1"]
+	c.mu.Unlock()
+	if kept {
+		t.Error("idle crawl's entries weren't dropped")
+	}
+}
+
+func TestMemberCacheInvalidate(t *testing.T) {
+	c := newMemberCache(time.Minute)
+
+	for _, crawlID := range []string{"", "c1"} {
+		c.put(crawlID, "iplant:de:prod:inner", "inner", []string{"alice"}, nil)
+		c.put(crawlID, "iplant:de:prod:outer", "outer", []string{"alice", "bob"}, []string{"inner"})
+		c.put(crawlID, "iplant:de:prod:other", "other", []string{"carol"}, nil)
+	}
+
+	c.invalidate("inner")
+
+	for _, crawlID := range []string{"", "c1"} {
+		if _, ok := c.get(crawlID, "iplant:de:prod:inner"); ok {
+			t.Errorf("invalidated group is still cached in %q", crawlID)
+		}
+		if _, ok := c.get(crawlID, "iplant:de:prod:outer"); ok {
+			t.Errorf("group containing the invalidated group is still cached in %q", crawlID)
+		}
+		if _, ok := c.get(crawlID, "iplant:de:prod:other"); !ok {
+			t.Errorf("unrelated group was dropped from %q", crawlID)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/cyverse-de/go-mod/restutils"
 	"github.com/cyverse-de/group-propagator/logging"
@@ -25,12 +26,15 @@ const otelName = "github.com/cyverse-de/group-propagator/client/groups"
 type DataInfoClient struct {
 	DataInfoBase string
 	DataInfoUser string
+
+	// How long each request may take, or 0 for no limit.
+	Timeout time.Duration
 }
 
 var httpClient = http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
-func NewDataInfoClient(base, user string) *DataInfoClient {
-	return &DataInfoClient{base, user}
+func NewDataInfoClient(base, user string, timeout time.Duration) *DataInfoClient {
+	return &DataInfoClient{DataInfoBase: base, DataInfoUser: user, Timeout: timeout}
 }
 
 func (d *DataInfoClient) uriPath(ctx context.Context, pathParts ...string) (string, error) {
@@ -46,6 +50,12 @@ func (d *DataInfoClient) uriPath(ctx context.Context, pathParts ...string) (stri
 }
 
 func (d *DataInfoClient) reqJSON(ctx context.Context, method, uri string, body io.Reader, target any) error {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
 	req, err := http.NewRequestWithContext(ctx, method, uri, body)
 	if err != nil {
 		return errors.Wrap(err, "Failed creating request with context")
@@ -169,3 +179,20 @@ func (d *DataInfoClient) DeleteGroup(ctx context.Context, name string) error {
 
 	return d.reqJSON(ctx, http.MethodDelete, uri, nil, nil)
 }
+
+// List the paths a group has been granted permissions on, such as to find
+// ACLs that would be stranded by renaming the group
+func (d *DataInfoClient) ListGroupPermissions(ctx context.Context, name string) (GroupPermissions, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "ListGroupPermissions")
+	defer span.End()
+
+	var p GroupPermissions
+
+	uri, err := d.uriPath(ctx, "groups", name, "permissions")
+	if err != nil {
+		return p, errors.Wrap(err, "Failed to build URL")
+	}
+
+	err = d.reqJSON(ctx, http.MethodGet, uri, nil, &p)
+	return p, err
+}
@@ -18,3 +18,12 @@ type ServiceError struct {
 	Users  []string
 	Group  string
 }
+
+type Permission struct {
+	Path       string `json:"path"`
+	Permission string `json:"permission"`
+}
+
+type GroupPermissions struct {
+	Permissions []Permission `json:"permissions"`
+}
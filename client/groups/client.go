@@ -185,3 +185,20 @@ func (c *GroupsClient) GetGroupMembers(ctx context.Context, groupName string) (G
 	err = c.getJSON(ctx, uri, &gm)
 	return gm, err
 }
+
+// List the groups a subject is a member of using the REST service, given a
+// subject ID. For groups that are members of other groups, the subject ID is
+// the member group's ID.
+func (c *GroupsClient) GetSubjectGroups(ctx context.Context, subjectID string) (GroupList, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "GetSubjectGroups")
+	defer span.End()
+
+	var gs GroupList
+	uri, err := c.uriPath(ctx, "", "subjects", url.PathEscape(subjectID), "groups")
+	if err != nil {
+		return gs, err
+	}
+
+	err = c.getJSON(ctx, uri, &gs)
+	return gs, err
+}
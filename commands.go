@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/config"
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+const commandUsage = `Commands:
+  config check                      validate the configuration and check that
+                                    everything it points to can be reached
+  crawl [--folder F] [--dry-run] [--force] [--targets T,...] [--workers N] [--reason R]
+                                    propagate every mapped group, or those in one
+                                    folder, in-process and print a summary; stop
+                                    the service first
+  held list [--api URL]             list changes held for review
+  held show [--api URL] [--target T] <id>
+                                    show the held change for a group
+  held approve [--api URL] [--token T] [--target T] <id>
+                                    apply the held change for a group
+  held reject [--api URL] [--token T] [--target T] <id>
+                                    discard the held change for a group
+  migrate [--dry-run] [--from-template T] [--report-acls] [--delete-old [--yes]]
+                                    move propagated groups to the names given by
+                                    the current mappings, or with --delete-old,
+                                    delete groups the service left behind when
+                                    renaming; stop the service first
+  restore [--dry-run] [--target T] <snapshot> [name ...]
+                                    reapply the memberships in a file target's
+                                    snapshot (a directory or a .jsonl file) to a
+                                    target, which --target must name if there's
+                                    more than one; stop the service first
+`
+
+// Run a command given on the command line instead of the service.
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "crawl":
+		return crawlCommand(cfg, args[1:])
+	case "held":
+		return heldCommand(cfg, args[1:])
+	case "migrate":
+		return migrateCommand(cfg, args[1:])
+	case "restore":
+		return restoreCommand(cfg, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, commandUsage)
+		return errors.Errorf("Unknown command %s", args[0])
+	}
+}
+
+// Open the state store for a command that changes it. The service holds the
+// store open, so it should be stopped first.
+func openCommandStore(cfg *config.Config) (store.Store, error) {
+	s, err := store.New(cfg.StatePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't open the state store; is the service still running?")
+	}
+	return s, nil
+}
+
+// The URL a running service's API can be reached at, given its listen address.
+func defaultAPIURL(listen string) string {
+	u := url.URL{Scheme: "http", Host: listen}
+	if u.Hostname() == "" {
+		u.Host = "localhost" + listen
+	}
+	return u.String()
+}
+
+// Send a request to a running service's API, with the token if there is
+// one, and print the JSON response.
+func callAPI(method, base, token string, query url.Values, pathParts ...string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse API URL")
+	}
+	u = u.JoinPath(pathParts...)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed creating request")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Failed requesting URL")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Failed reading response")
+	}
+
+	var v any
+	if err = json.Unmarshal(body, &v); err != nil {
+		return errors.Wrapf(err, "%s %s returned %d", method, u, resp.StatusCode)
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed formatting response")
+	}
+	fmt.Println(string(out))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s %s returned %d", method, u, resp.StatusCode)
+	}
+	return nil
+}
+
+func heldCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("held", flag.ExitOnError)
+	apiURL := fs.String("api", defaultAPIURL(cfg.APIListen), "The URL of a running group-propagator's API")
+	target := fs.String("target", "", "The data-info target the change is held in, if not the first configured")
+	token := fs.String("token", cfg.APIToken, "The API token, if not the configured one")
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return errors.New("held requires a subcommand")
+	}
+	sub := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if sub == "list" {
+		return callAPI(http.MethodGet, *apiURL, *token, nil, "held")
+	}
+
+	if fs.NArg() != 1 {
+		return errors.Errorf("held %s requires a group ID", sub)
+	}
+	groupID := fs.Arg(0)
+
+	query := url.Values{}
+	if *target != "" {
+		query.Set("target", *target)
+	}
+
+	switch sub {
+	case "show":
+		return callAPI(http.MethodGet, *apiURL, *token, query, "held", groupID)
+	case "approve":
+		return callAPI(http.MethodPost, *apiURL, *token, query, "held", groupID, "approve")
+	case "reject":
+		return callAPI(http.MethodPost, *apiURL, *token, query, "held", groupID, "reject")
+	default:
+		fmt.Fprint(os.Stderr, commandUsage)
+		return errors.Errorf("Unknown held subcommand %s", sub)
+	}
+}
@@ -1,12 +1,56 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+
+	"github.com/cyverse-de/group-propagator/filter"
+	"github.com/cyverse-de/group-propagator/naming"
+	"github.com/cyverse-de/group-propagator/sink"
+	"github.com/cyverse-de/group-propagator/store"
 )
 
+// Mapping propagates the groups within a Grouper folder to iRODS groups named
+// by a template. See the naming package for the template format.
+type Mapping struct {
+	Folder            string `mapstructure:"folder"`
+	IRODSNameTemplate string `mapstructure:"irods_name_template"`
+	Sensitive         bool   `mapstructure:"sensitive"`
+
+	// The names of the targets to propagate to, or all targets if empty.
+	Targets []string `mapstructure:"targets"`
+}
+
+// The kinds of targets groups can be propagated to.
+const (
+	TargetDataInfo = "data-info"
+	TargetLDAP     = "ldap"
+	TargetFile     = "file"
+)
+
+// Target is somewhere groups are propagated to: a data-info service for one
+// iRODS zone or grid, an LDAP directory, or a directory of snapshot files.
+type Target struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+
+	// For data-info targets.
+	Base      string `mapstructure:"base"`
+	IRODSUser string `mapstructure:"irods_user"`
+
+	// For LDAP targets.
+	LDAP sink.LDAPOptions `mapstructure:"ldap"`
+
+	// For file targets.
+	File sink.FileOptions `mapstructure:"file"`
+}
+
 type Config struct {
 	IplantGroupsBase             string
 	IplantGroupsUser             string
@@ -16,13 +60,59 @@ type Config struct {
 	DataInfoBase string
 	IRODSUser    string
 
+	Targets          []Target
+	TargetRetries    int
+	TargetRetryDelay time.Duration
+	TargetTimeout    time.Duration
+
 	AMQPURI          string
 	AMQPExchangeName string
 	AMQPExchangeType string
 	AMQPQueuePrefix  string
+
+	StatePath string
+
+	MemberCacheTTL time.Duration
+
+	// Whether to skip groups whose membership hashes match the last applied.
+	SkipUnchanged bool
+
+	SafetyMaxRemovalPercent float64
+	SafetyMinGroupSize      int
+	SafetyMaxRemovals       int
+	SafetyMaxCrawlDeletions int
+	SafetyMaxCrawlFailures  int
+	SafetyVerifyNotFound    bool
+	SafetySensitiveGroups   []string
+
+	APIListen string
+
+	// Required to change anything through the API, if set.
+	APIToken string
+
+	ShutdownTimeout time.Duration
+
+	// Whether crawls propagate each group themselves, with this many workers,
+	// instead of publishing a message for each.
+	CrawlDirect  bool
+	CrawlWorkers int
+
+	FilterInclude        []filter.Rule
+	FilterExclude        []filter.Rule
+	ProtectedIRODSGroups []string
+
+	Mappings []Mapping
+
+	// Where overridden keys got their values, for error messages.
+	Sources map[string]string
 }
 
 func NewFromViper(cfg *viper.Viper) (*Config, error) {
+	sources, err := applyOverrides(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	c := &Config{
 		IplantGroupsBase:             cfg.GetString("iplant_groups.base"),
 		IplantGroupsUser:             cfg.GetString("iplant_groups.user"),
@@ -32,13 +122,86 @@ func NewFromViper(cfg *viper.Viper) (*Config, error) {
 		DataInfoBase: cfg.GetString("data_info.base"),
 		IRODSUser:    cfg.GetString("irods.user"),
 
+		TargetRetries:    cfg.GetInt("data_info.retries"),
+		TargetRetryDelay: cfg.GetDuration("data_info.retry_delay"),
+		TargetTimeout:    cfg.GetDuration("data_info.timeout"),
+
 		AMQPURI:          cfg.GetString("amqp.uri"),
 		AMQPExchangeName: cfg.GetString("amqp.exchange.name"),
 		AMQPExchangeType: cfg.GetString("amqp.exchange.type"),
 		AMQPQueuePrefix:  cfg.GetString("amqp.queue_prefix"),
+
+		StatePath: cfg.GetString("state.path"),
+
+		MemberCacheTTL: cfg.GetDuration("propagator.member_cache_ttl"),
+		SkipUnchanged:  cfg.GetBool("propagator.skip_unchanged"),
+
+		SafetyMaxRemovalPercent: cfg.GetFloat64("safety.max_removal_percent"),
+		SafetyMinGroupSize:      cfg.GetInt("safety.min_group_size"),
+		SafetyMaxRemovals:       cfg.GetInt("safety.max_removals"),
+		SafetyMaxCrawlDeletions: cfg.GetInt("safety.max_crawl_deletions"),
+		SafetyMaxCrawlFailures:  cfg.GetInt("safety.max_crawl_failures"),
+		SafetyVerifyNotFound:    cfg.GetBool("safety.verify_not_found"),
+		SafetySensitiveGroups:   cfg.GetStringSlice("safety.sensitive_groups"),
+
+		APIListen: cfg.GetString("api.listen"),
+		APIToken:  cfg.GetString("api.token"),
+
+		ShutdownTimeout: cfg.GetDuration("shutdown.timeout"),
+
+		CrawlDirect:  cfg.GetBool("crawl.direct"),
+		CrawlWorkers: cfg.GetInt("crawl.workers"),
+
+		ProtectedIRODSGroups: cfg.GetStringSlice("filters.protected_irods_groups"),
+
+		Sources: sources,
+	}
+
+	if password := cfg.GetString("amqp.password"); password != "" {
+		if c.AMQPURI, err = withPassword(c.AMQPURI, password); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.UnmarshalKey("filters.include", &c.FilterInclude); err != nil {
+		return nil, errors.Wrap(err, "Failed reading filters.include")
+	}
+	if err := cfg.UnmarshalKey("filters.exclude", &c.FilterExclude); err != nil {
+		return nil, errors.Wrap(err, "Failed reading filters.exclude")
+	}
+	if err := cfg.UnmarshalKey("mappings", &c.Mappings); err != nil {
+		return nil, errors.Wrap(err, "Failed reading mappings")
+	}
+	if err := cfg.UnmarshalKey("data_info.targets", &c.Targets); err != nil {
+		return nil, errors.Wrap(err, "Failed reading data_info.targets")
+	}
+
+	// Without explicit targets, propagate to the single configured data-info.
+	if len(c.Targets) == 0 && c.DataInfoBase != "" && c.IRODSUser != "" {
+		c.Targets = []Target{{Name: store.DefaultTarget, Base: c.DataInfoBase, IRODSUser: c.IRODSUser}}
+	}
+	for i := range c.Targets {
+		if c.Targets[i].Type == "" {
+			c.Targets[i].Type = TargetDataInfo
+		}
 	}
 
-	err := c.Validate()
+	// Without explicit mappings, propagate the single configured folder
+	// using the original naming scheme.
+	if len(c.Mappings) == 0 && c.IplantGroupsFolderNamePrefix != "" {
+		c.Mappings = []Mapping{{Folder: c.IplantGroupsFolderNamePrefix, IRODSNameTemplate: naming.DefaultTemplate}}
+	}
+
+	for i := range c.Targets {
+		l := &c.Targets[i].LDAP
+		if l.BindPasswordFile != "" {
+			if l.BindPassword, err = readValueFile(l.BindPasswordFile); err != nil {
+				return nil, errors.Wrapf(err, "Failed reading data_info.targets[%d].ldap.bind_password_file", i)
+			}
+		}
+	}
+
+	err = c.Validate()
 	if err != nil {
 		return nil, err
 	}
@@ -49,38 +212,234 @@ func (c *Config) Validate() error {
 	var errorkeys []string
 
 	if c.IplantGroupsBase == "" {
-		errorkeys = append(errorkeys, "iplant_groups.base")
+		errorkeys = append(errorkeys, c.describe("iplant_groups.base"))
 	}
 	if c.IplantGroupsUser == "" {
-		errorkeys = append(errorkeys, "iplant_groups.user")
+		errorkeys = append(errorkeys, c.describe("iplant_groups.user"))
 	}
-	if c.IplantGroupsFolderNamePrefix == "" {
-		errorkeys = append(errorkeys, "iplant_groups.folder_name_prefix")
+	if c.IplantGroupsFolderNamePrefix == "" && len(c.Mappings) == 0 {
+		errorkeys = append(errorkeys, c.describe("iplant_groups.folder_name_prefix"))
 	}
 	if c.IplantGroupsPublicGroup == "" {
-		errorkeys = append(errorkeys, "iplant_groups.public_group")
+		errorkeys = append(errorkeys, c.describe("iplant_groups.public_group"))
 	}
 
-	if c.DataInfoBase == "" {
-		errorkeys = append(errorkeys, "data_info.base")
-	}
-	if c.IRODSUser == "" {
-		errorkeys = append(errorkeys, "irods.user")
+	if len(c.Targets) == 0 {
+		if c.DataInfoBase == "" {
+			errorkeys = append(errorkeys, c.describe("data_info.base"))
+		}
+		if c.IRODSUser == "" {
+			errorkeys = append(errorkeys, c.describe("irods.user"))
+		}
 	}
 
 	if c.AMQPURI == "" {
-		errorkeys = append(errorkeys, "amqp.uri")
+		errorkeys = append(errorkeys, c.describe("amqp.uri"))
 	}
 	if c.AMQPExchangeName == "" {
-		errorkeys = append(errorkeys, "amqp.exchange.name")
+		errorkeys = append(errorkeys, c.describe("amqp.exchange.name"))
 	}
 	if c.AMQPExchangeType == "" {
-		errorkeys = append(errorkeys, "amqp.exchange.type")
+		errorkeys = append(errorkeys, c.describe("amqp.exchange.type"))
+	}
+
+	if c.APIListen == "" {
+		errorkeys = append(errorkeys, c.describe("api.listen"))
 	}
 	// AMQPQueuePrefix can be the empty string (usually will be, probably)
+	// StatePath can be the empty string, which keeps state in memory
 
 	if len(errorkeys) > 0 {
 		return errors.Errorf("Configuration keys must be set: %s", strings.Join(errorkeys, ", "))
 	}
+
+	var negativekeys []string
+
+	if c.MemberCacheTTL < 0 {
+		negativekeys = append(negativekeys, c.describe("propagator.member_cache_ttl"))
+	}
+	if c.SafetyMaxRemovalPercent < 0 {
+		negativekeys = append(negativekeys, c.describe("safety.max_removal_percent"))
+	}
+	if c.SafetyMinGroupSize < 0 {
+		negativekeys = append(negativekeys, c.describe("safety.min_group_size"))
+	}
+	if c.SafetyMaxRemovals < 0 {
+		negativekeys = append(negativekeys, c.describe("safety.max_removals"))
+	}
+	if c.SafetyMaxCrawlDeletions < 0 {
+		negativekeys = append(negativekeys, c.describe("safety.max_crawl_deletions"))
+	}
+	if c.SafetyMaxCrawlFailures < 0 {
+		negativekeys = append(negativekeys, c.describe("safety.max_crawl_failures"))
+	}
+	if c.TargetRetries < 0 {
+		negativekeys = append(negativekeys, c.describe("data_info.retries"))
+	}
+	if c.ShutdownTimeout < 0 {
+		negativekeys = append(negativekeys, c.describe("shutdown.timeout"))
+	}
+	if c.TargetRetryDelay < 0 {
+		negativekeys = append(negativekeys, c.describe("data_info.retry_delay"))
+	}
+	if c.TargetTimeout < 0 {
+		negativekeys = append(negativekeys, c.describe("data_info.timeout"))
+	}
+	if c.CrawlWorkers < 0 {
+		negativekeys = append(negativekeys, c.describe("crawl.workers"))
+	}
+
+	if len(negativekeys) > 0 {
+		return errors.Errorf("Configuration keys must not be negative: %s", strings.Join(negativekeys, ", "))
+	}
+
+	if err := checkURL(c.IplantGroupsBase, "http", "https"); err != nil {
+		return errors.Wrapf(err, "Invalid %s", c.describe("iplant_groups.base"))
+	}
+	if err := checkURL(c.AMQPURI, "amqp", "amqps"); err != nil {
+		return errors.Wrapf(err, "Invalid %s", c.describe("amqp.uri"))
+	}
+	// Requests are published to a topic exchange and bound with wildcards,
+	// so no other type can route them.
+	if c.AMQPExchangeType != "topic" {
+		return errors.Errorf("Configuration key %s must be topic, not %s", c.describe("amqp.exchange.type"), c.AMQPExchangeType)
+	}
+	// Hashes kept in memory are lost on restart and differ between instances,
+	// so a group changed back to an earlier membership could be skipped.
+	if c.SkipUnchanged && c.StatePath == "" {
+		return errors.Errorf("Configuration key %s requires state.path to be set", c.describe("propagator.skip_unchanged"))
+	}
+	if c.CrawlDirect && c.CrawlWorkers == 0 {
+		return errors.Errorf("Configuration key %s must be at least 1 when crawl.direct is set", c.describe("crawl.workers"))
+	}
+	if _, _, err := net.SplitHostPort(c.APIListen); err != nil {
+		return errors.Wrapf(err, "Invalid %s", c.describe("api.listen"))
+	}
+
+	for i := range c.FilterInclude {
+		if err := c.FilterInclude[i].Validate(); err != nil {
+			return errors.Wrap(err, "Invalid rule in "+c.describe("filters.include"))
+		}
+	}
+	for i := range c.FilterExclude {
+		if err := c.FilterExclude[i].Validate(); err != nil {
+			return errors.Wrap(err, "Invalid rule in "+c.describe("filters.exclude"))
+		}
+	}
+
+	targetNames := make(map[string]bool)
+	for i, t := range c.Targets {
+		if t.Name == "" {
+			return errors.Errorf("Configuration key %s must be set", c.describe(fmt.Sprintf("data_info.targets[%d].name", i)))
+		}
+		switch t.Type {
+		case TargetDataInfo:
+			if t.Base == "" || t.IRODSUser == "" {
+				return errors.Errorf("Configuration keys %s and irods_user must be set", c.describe(fmt.Sprintf("data_info.targets[%d].base", i)))
+			}
+			if err := checkURL(t.Base, "http", "https"); err != nil {
+				return errors.Wrapf(err, "Invalid %s", c.describe(fmt.Sprintf("data_info.targets[%d].base", i)))
+			}
+		case TargetLDAP:
+			if err := t.LDAP.Validate(); err != nil {
+				return errors.Wrapf(err, "Invalid configuration in %s", c.describe(fmt.Sprintf("data_info.targets[%d].ldap", i)))
+			}
+		case TargetFile:
+			if err := t.File.Validate(); err != nil {
+				return errors.Wrapf(err, "Invalid configuration in %s", c.describe(fmt.Sprintf("data_info.targets[%d].file", i)))
+			}
+		default:
+			return errors.Errorf("Configuration key %s must be %s, %s or %s", c.describe(fmt.Sprintf("data_info.targets[%d].type", i)), TargetDataInfo, TargetLDAP, TargetFile)
+		}
+		if strings.Contains(t.Name, "/") {
+			return errors.Errorf("Configuration key %s must not contain a slash", c.describe(fmt.Sprintf("data_info.targets[%d].name", i)))
+		}
+		if targetNames[t.Name] {
+			return errors.Errorf("Configuration key %s duplicates target %s", c.describe(fmt.Sprintf("data_info.targets[%d].name", i)), t.Name)
+		}
+		targetNames[t.Name] = true
+	}
+
+	for i, m := range c.Mappings {
+		if m.Folder == "" {
+			return errors.Errorf("Configuration key %s must be set", c.describe(fmt.Sprintf("mappings[%d].folder", i)))
+		}
+		if strings.HasSuffix(m.Folder, ":") {
+			return errors.Errorf("Configuration key %s must not end with a colon", c.describe(fmt.Sprintf("mappings[%d].folder", i)))
+		}
+		if _, err := naming.Parse(m.IRODSNameTemplate); err != nil {
+			return errors.Wrapf(err, "Invalid template in %s", c.describe(fmt.Sprintf("mappings[%d]", i)))
+		}
+		// Groups with the original names are recognized without any state,
+		// but groups with other names would be refused as belonging to
+		// someone else once a restart empties the in-memory store.
+		if c.StatePath == "" && m.IRODSNameTemplate != naming.DefaultTemplate {
+			return errors.Errorf("Configuration key %s requires state.path to be set, since it isn't the default", c.describe(fmt.Sprintf("mappings[%d].irods_name_template", i)))
+		}
+		for _, t := range m.Targets {
+			if !targetNames[t] {
+				return errors.Errorf("Configuration key %s refers to unknown target %s", c.describe(fmt.Sprintf("mappings[%d].targets", i)), t)
+			}
+		}
+	}
+
+	// The public group is excluded from crawls of the folder it's in, so it
+	// has to be a group within one of the mapped folders, named in full.
+	if c.PublicGroupFolder() == "" {
+		return errors.Errorf("Configuration key %s must be the full name of a group within a mapped folder, such as <folder>:users:de-users", c.describe("iplant_groups.public_group"))
+	}
 	return nil
 }
+
+// PublicGroupFolder returns the most specific mapped folder the public group
+// is within, or "" if it isn't within any.
+func (c *Config) PublicGroupFolder() string {
+	var found string
+	for _, m := range c.Mappings {
+		name, ok := strings.CutPrefix(c.IplantGroupsPublicGroup, m.Folder+":")
+		if ok && name != "" && !strings.HasSuffix(name, ":") && len(m.Folder) > len(found) {
+			found = m.Folder
+		}
+	}
+	return found
+}
+
+// Check that a URL parses, has one of the given schemes and names a host.
+func checkURL(rawURL string, schemes ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// The parse error quotes the URL, which may include a password.
+		return errors.New("not a valid URL")
+	}
+
+	valid := false
+	for _, s := range schemes {
+		valid = valid || u.Scheme == s
+	}
+	if !valid {
+		return errors.Errorf("%s must use %s", u.Redacted(), strings.Join(schemes, " or "))
+	}
+	if u.Host == "" {
+		return errors.Errorf("%s must include a host", u.Redacted())
+	}
+	return nil
+}
+
+// Warnings returns settings that are valid but probably not what was meant.
+func (c *Config) Warnings() []string {
+	var warnings []string
+
+	if c.StatePath == "" {
+		warnings = append(warnings, fmt.Sprintf("%s is empty, so propagation state and changes held for review are lost on restart", c.describe("state.path")))
+	}
+	if c.APIToken == "" {
+		warnings = append(warnings, fmt.Sprintf("%s is empty, so held changes can only be approved or rejected from the same host", c.describe("api.token")))
+	}
+
+	for i, t := range c.Targets {
+		if t.Type == TargetLDAP && t.LDAP.BindPassword != "" && t.LDAP.BindPasswordFile == "" {
+			warnings = append(warnings, fmt.Sprintf("%s is set directly; consider bind_password_file", c.describe(fmt.Sprintf("data_info.targets[%d].ldap.bind_password", i))))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of the environment variable that overrides each
+// configuration key. The rest of the name is the key, upper-cased with dots
+// replaced by underscores, so GROUP_PROPAGATOR_AMQP_URI overrides amqp.uri.
+// Adding _FILE to the name reads the value from a file instead, such as a
+// mounted secret, as does adding _file to the key in the configuration file.
+const EnvPrefix = "GROUP_PROPAGATOR"
+
+// Keys lists every configuration key that can be overridden.
+var Keys = []string{
+	"iplant_groups.base",
+	"iplant_groups.user",
+	"iplant_groups.folder_name_prefix",
+	"iplant_groups.public_group",
+	"data_info.base",
+	"data_info.targets",
+	"data_info.retries",
+	"data_info.retry_delay",
+	"data_info.timeout",
+	"irods.user",
+	"amqp.uri",
+	"amqp.password",
+	"amqp.queue_prefix",
+	"amqp.exchange.name",
+	"amqp.exchange.type",
+	"state.path",
+	"propagator.member_cache_ttl",
+	"propagator.skip_unchanged",
+	"safety.max_removal_percent",
+	"safety.min_group_size",
+	"safety.max_removals",
+	"safety.max_crawl_deletions",
+	"safety.max_crawl_failures",
+	"safety.verify_not_found",
+	"safety.sensitive_groups",
+	"api.listen",
+	"api.token",
+	"shutdown.timeout",
+	"crawl.direct",
+	"crawl.workers",
+	"filters.include",
+	"filters.exclude",
+	"filters.protected_irods_groups",
+	"mappings",
+}
+
+// Keys whose values are lists, which are given in YAML or JSON when
+// overridden. Without parsing, lists of strings would be split on
+// whitespace, which Grouper group names can contain.
+var structuredKeys = map[string]bool{
+	"data_info.targets":              true,
+	"safety.sensitive_groups":        true,
+	"filters.include":                true,
+	"filters.exclude":                true,
+	"filters.protected_irods_groups": true,
+	"mappings":                       true,
+}
+
+// EnvName returns the environment variable that overrides a key.
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Read a secret from a file, dropping the trailing newline most editors and
+// secret mounts leave.
+func readValueFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed reading %s", path)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// Apply the overrides for every key to the viper instance, in increasing
+// precedence: a _file key in the configuration file, then an environment
+// variable, then a _FILE environment variable. Returns where each
+// overridden value came from; the rest came from the configuration file or
+// the defaults.
+func applyOverrides(cfg *viper.Viper) (map[string]string, error) {
+	sources := make(map[string]string)
+
+	for _, key := range Keys {
+		var (
+			value  string
+			source string
+		)
+
+		if path := cfg.GetString(key + "_file"); path != "" {
+			v, err := readValueFile(path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed reading %s_file", key)
+			}
+			value, source = v, fmt.Sprintf("file %s named by %s_file", path, key)
+		}
+
+		env := EnvName(key)
+		if v, ok := os.LookupEnv(env); ok {
+			value, source = v, "environment variable "+env
+		}
+
+		if path, ok := os.LookupEnv(env + "_FILE"); ok {
+			v, err := readValueFile(path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed reading %s_FILE", env)
+			}
+			value, source = v, fmt.Sprintf("file %s named by %s_FILE", path, env)
+		}
+
+		if source == "" {
+			continue
+		}
+
+		if structuredKeys[key] {
+			var parsed any
+			if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+				return nil, errors.Wrapf(err, "Failed parsing %s from %s", key, source)
+			}
+			cfg.Set(key, parsed)
+		} else {
+			cfg.Set(key, value)
+		}
+		sources[key] = source
+	}
+
+	return sources, nil
+}
+
+// Put a separately configured password into a URI, so the rest of the URI
+// needn't be kept secret.
+func withPassword(uri, password string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed parsing amqp.uri")
+	}
+
+	var user string
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	u.User = url.UserPassword(user, password)
+	return u.String(), nil
+}
+
+// Describe a key for an error message, with where its value came from if it
+// was overridden. Keys can index into lists, like mappings[0].folder.
+func (c *Config) describe(key string) string {
+	top, _, _ := strings.Cut(key, "[")
+	if source, ok := c.Sources[top]; ok {
+		return fmt.Sprintf("%s (from %s)", key, source)
+	}
+	return key
+}
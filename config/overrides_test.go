@@ -0,0 +1,127 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Write a value to a file in the test's temporary directory.
+func writeValue(t *testing.T, name, value string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyOverridesPrecedence(t *testing.T) {
+	const key = "amqp.uri"
+
+	keyFile := writeValue(t, "key-file", "from key file\n")
+	envFile := writeValue(t, "env-file", "from env file\n")
+
+	tests := []struct {
+		name    string
+		keyFile bool
+		env     bool
+		envFile bool
+		want    string
+		source  string
+	}{
+		{"configuration file", false, false, false, "from config", ""},
+		{"_file key", true, false, false, "from key file", "file " + keyFile + " named by amqp.uri_file"},
+		{"environment variable", true, true, false, "from env", "environment variable GROUP_PROPAGATOR_AMQP_URI"},
+		{"_FILE environment variable", true, true, true, "from env file", "file " + envFile + " named by GROUP_PROPAGATOR_AMQP_URI_FILE"},
+		{"_FILE environment variable alone", false, false, true, "from env file", "file " + envFile + " named by GROUP_PROPAGATOR_AMQP_URI_FILE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := viper.New()
+			cfg.Set(key, "from config")
+			if tt.keyFile {
+				cfg.Set(key+"_file", keyFile)
+			}
+			if tt.env {
+				t.Setenv(EnvName(key), "from env")
+			}
+			if tt.envFile {
+				t.Setenv(EnvName(key)+"_FILE", envFile)
+			}
+
+			sources, err := applyOverrides(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.GetString(key); got != tt.want {
+				t.Errorf("%s = %q, want %q", key, got, tt.want)
+			}
+			if got := sources[key]; got != tt.source {
+				t.Errorf("source of %s = %q, want %q", key, got, tt.source)
+			}
+		})
+	}
+}
+
+func TestApplyOverridesStructured(t *testing.T) {
+	t.Setenv(EnvName("mappings"), `[{folder: "iplant:de:courses", irods_name_template: "course-{{.Extension}}"}]`)
+
+	cfg := viper.New()
+	if _, err := applyOverrides(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var mappings []Mapping
+	if err := cfg.UnmarshalKey("mappings", &mappings); err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 1 || mappings[0].Folder != "iplant:de:courses" || mappings[0].IRODSNameTemplate != "course-{{.Extension}}" {
+		t.Errorf("mappings = %+v", mappings)
+	}
+}
+
+func TestApplyOverridesLists(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"JSON", `["iplant:de:prod:Payroll Office", "abc123"]`, []string{"iplant:de:prod:Payroll Office", "abc123"}},
+		{"YAML", "- iplant:de:prod:Payroll Office\n- abc123", []string{"iplant:de:prod:Payroll Office", "abc123"}},
+		{"single name", "iplant:de:prod:payroll", []string{"iplant:de:prod:payroll"}},
+	}
+
+	for _, key := range []string{"safety.sensitive_groups", "filters.protected_irods_groups"} {
+		for _, tt := range tests {
+			t.Run(key+" "+tt.name, func(t *testing.T) {
+				t.Setenv(EnvName(key), tt.value)
+
+				cfg := viper.New()
+				if _, err := applyOverrides(cfg); err != nil {
+					t.Fatal(err)
+				}
+				if got := cfg.GetStringSlice(key); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s = %q, want %q", key, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestApplyOverridesMissingFile(t *testing.T) {
+	t.Setenv(EnvName("amqp.password")+"_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	if _, err := applyOverrides(viper.New()); err == nil {
+		t.Error("applyOverrides succeeded with a missing file")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("amqp.exchange.name"); got != "GROUP_PROPAGATOR_AMQP_EXCHANGE_NAME" {
+		t.Errorf("EnvName = %s", got)
+	}
+}
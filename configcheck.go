@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+)
+
+// How long each connectivity check may take.
+const checkTimeout = 10 * time.Second
+
+// checkReport prints the outcome of each check as it's made and counts the failures.
+type checkReport struct {
+	failures int
+}
+
+func (r *checkReport) section(title string) {
+	fmt.Printf("\n%s\n", title)
+}
+
+func (r *checkReport) ok(format string, args ...any) {
+	fmt.Printf("  ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) warn(format string, args ...any) {
+	fmt.Printf("  warn  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) fail(err error, format string, args ...any) {
+	r.failures++
+	fmt.Printf("  FAIL  %s: %s\n", fmt.Sprintf(format, args...), err)
+}
+
+// Report on a check that either passes or fails.
+func (r *checkReport) check(err error, format string, args ...any) {
+	if err != nil {
+		r.fail(err, format, args...)
+	} else {
+		r.ok(format, args...)
+	}
+}
+
+func redactedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
+
+func checkAMQP(uri string) error {
+	conn, err := amqp.DialConfig(uri, amqp.Config{Dial: amqp.DefaultDial(checkTimeout)})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Check the configuration, then try reaching everything it points to.
+func checkConfig(path string) error {
+	r := &checkReport{}
+
+	r.section("Configuration")
+
+	version, err := configVersion(path)
+	if err != nil {
+		r.fail(err, "read %s", path)
+		return errors.New("The configuration couldn't be read")
+	}
+	if version == "defaults" {
+		r.warn("%s doesn't exist, so only the defaults are used", path)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		r.fail(err, "validate version %s", version)
+		return errors.New("The configuration is invalid")
+	}
+	r.ok("validate version %s", version)
+
+	var keys []string
+	for key := range cfg.Sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r.ok("%s is set by %s", key, cfg.Sources[key])
+	}
+	for _, w := range cfg.Warnings() {
+		r.warn("%s", w)
+	}
+
+	mappings, err := NewMappings(cfg.Mappings)
+	if err != nil {
+		r.fail(err, "folder mappings")
+	}
+	if folder := cfg.PublicGroupFolder(); folder != "" {
+		r.ok("public group %s is within the mapped folder %s, and is excluded from propagation", cfg.IplantGroupsPublicGroup, folder)
+	} else {
+		r.fail(errors.Errorf("%s isn't within any mapped folder", cfg.IplantGroupsPublicGroup), "public group")
+	}
+
+	r.section("Connectivity")
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	gc := groups.NewGroupsClient(cfg.IplantGroupsBase, cfg.IplantGroupsUser, cfg.IplantGroupsPublicGroup)
+	err = gc.Check(ctx)
+	r.check(err, "iplant-groups at %s", cfg.IplantGroupsBase)
+
+	if err == nil {
+		r.check(gc.SetGroupsID(ctx), "public group %s", cfg.IplantGroupsPublicGroup)
+
+		for _, m := range mappings {
+			gs, err := gc.ListGroupsByPrefix(ctx, m.Folder, m.Folder)
+			if err != nil {
+				r.fail(err, "folder %s", m.Folder)
+			} else {
+				r.ok("folder %s has %d groups", m.Folder, len(gs.Groups))
+			}
+		}
+	}
+
+	for _, t := range NewTargets(cfg) {
+		r.check(t.Sink.Check(ctx), "target %s", t.Name)
+	}
+
+	r.check(checkAMQP(cfg.AMQPURI), "AMQP broker at %s", redactedURL(cfg.AMQPURI))
+
+	fmt.Println()
+	if r.failures > 0 {
+		return errors.Errorf("%d checks failed", r.failures)
+	}
+	fmt.Println("All checks passed")
+	return nil
+}
+
+// Run a config subcommand. These load the configuration themselves, so they
+// can report problems with it instead of failing to start.
+func configCommand(path string, args []string) error {
+	if len(args) == 1 && args[0] == "check" {
+		return checkConfig(path)
+	}
+
+	fmt.Fprint(os.Stderr, commandUsage)
+	return errors.New("config requires the check subcommand")
+}
@@ -3,55 +3,270 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync/atomic"
 
+	"github.com/cyverse-de/group-propagator/broker"
 	"github.com/cyverse-de/group-propagator/client/groups"
-	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/group-propagator/store"
 	"github.com/pkg/errors"
 
 	"go.opentelemetry.io/otel"
 )
 
 type Crawler struct {
-	groupsClient    *groups.GroupsClient
-	groupBaseFolder string
-	publicGroup     string
+	groupsClient *groups.GroupsClient
+	rules        *atomic.Pointer[Rules]
+	targets      map[string]bool
 
 	// maybe a data-info client too for irods crawling?
 
-	publishClient *messaging.Client
+	publishClient *broker.Broker
+
+	stateStore store.Store
+	crawls     *crawlTracker
+
+	// If set, groups are propagated in-process by the number of workers the
+	// rules give rather than by publishing messages.
+	propagator *Propagator
 }
 
-func NewCrawler(groupsClient *groups.GroupsClient, groupBaseFolder, publicGroup string, publishClient *messaging.Client) *Crawler {
+func NewCrawler(groupsClient *groups.GroupsClient, rules *atomic.Pointer[Rules], targets []*Target, publishClient *broker.Broker, stateStore store.Store, crawls *crawlTracker) *Crawler {
+	targetNames := make(map[string]bool)
+	for _, t := range targets {
+		targetNames[t.Name] = true
+	}
+
 	return &Crawler{
-		groupsClient:    groupsClient,
-		groupBaseFolder: groupBaseFolder,
-		publicGroup:     publicGroup,
-		publishClient:   publishClient,
+		groupsClient:  groupsClient,
+		rules:         rules,
+		targets:       targetNames,
+		publishClient: publishClient,
+		stateStore:    stateStore,
+		crawls:        crawls,
+	}
+}
+
+// Propagate crawled groups in-process with a pool of workers, so a crawl
+// finishes only once every group has been propagated.
+func (c *Crawler) PropagateDirectly(propagator *Propagator) {
+	c.propagator = propagator
+}
+
+// List the groups in every mapped folder, once each even if folders overlap.
+// Any failure fails the whole listing, since an incomplete listing would make
+// groups look like they'd been deleted.
+func listMappedGroups(ctx context.Context, groupsClient *groups.GroupsClient, mappings []*Mapping) ([]groups.Group, error) {
+	var all []groups.Group
+	seen := make(map[string]bool)
+
+	for _, m := range mappings {
+		gs, err := groupsClient.ListGroupsByPrefix(ctx, m.Folder, m.Folder) // same thing passed twice: as prefix for group search and for folder to search within
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed listing groups in %s", m.Folder)
+		}
+
+		for _, g := range gs.Groups {
+			if !seen[g.ID] {
+				seen[g.ID] = true
+				all = append(all, g)
+			}
+		}
+	}
+
+	return all, nil
+}
+
+// Find groups within the mapped folders that have been propagated to a
+// configured target before but are no longer listed in Grouper. There is a
+// state for each target the group still needs deleting from.
+func (c *Crawler) findMissingGroups(rules *Rules, gs []groups.Group) ([]store.GroupState, error) {
+	listed := make(map[string]bool)
+	for _, g := range gs {
+		listed[g.ID] = true
+	}
+
+	states, err := c.stateStore.ListGroupStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []store.GroupState
+	for _, s := range states {
+		if s.LastResult == store.ResultDeleted || listed[s.GroupID] || !c.targets[s.Target] {
+			continue
+		}
+		m := mappingFor(rules.Mappings, s.GroupName)
+		if m == nil || !m.Selects(s.Target) {
+			continue
+		}
+		if !rules.Filter.Allows(s.GroupID, s.GroupName) || rules.Filter.IsProtected(s.IRODSName) {
+			continue
+		}
+		missing = append(missing, s)
+	}
+	return missing, nil
+}
+
+// Request propagation of groups that no longer exist in Grouper so that their
+// iRODS groups are deleted, unless there are more of them than the configured
+// limit, in which case they're held for review.
+// Failures for individual groups count towards the crawl's failures, leaving
+// only a failure to find the missing groups to be returned.
+func (c *Crawler) crawlMissingGroups(ctx context.Context, rules *Rules, gs []groups.Group, run *crawlRun) error {
+	req := run.req
+
+	missing, err := c.findMissingGroups(rules, gs)
+	if err != nil {
+		return errors.Wrap(err, "Failed finding groups missing from Grouper")
+	}
+
+	// Each group counts once, however many targets it's deleted from.
+	var missingIDs []string
+	seen := make(map[string]bool)
+	for _, s := range missing {
+		if !seen[s.GroupID] {
+			seen[s.GroupID] = true
+			missingIDs = append(missingIDs, s.GroupID)
+		}
+	}
+
+	maxDeletions := rules.Safety.MaxCrawlDeletions
+	if maxDeletions > 0 && len(missingIDs) > maxDeletions {
+		reason := fmt.Sprintf("crawl would delete %d groups, more than the limit of %d", len(missingIDs), maxDeletions)
+		if req.DryRun {
+			log.WithFields(req.fields()).Infof("Would hold deletions for review: %s", reason)
+			return nil
+		}
+		log.Errorf("Holding deletions for review: %s", reason)
+
+		for i := range missing {
+			s := &missing[i]
+			plan := &Plan{Target: s.Target, GroupID: s.GroupID, GroupName: s.GroupName, IRODSName: s.IRODSName, Delete: true}
+			if err := holdChange(c.stateStore, &HeldError{Plan: plan, Reason: reason}); err != nil {
+				err = errors.Wrapf(err, "Failed holding deletion of group %s in %s", s.GroupID, s.Target)
+				log.Error(err)
+				run.fail(s.GroupID, err)
+				continue
+			}
+
+			s.LastResult = store.ResultHeld
+			s.HeldReason = reason
+			if err := c.stateStore.PutGroupState(s); err != nil {
+				log.Error(errors.Wrapf(err, "Failed saving state for group %s in %s", s.GroupID, s.Target))
+			}
+		}
+		return nil
+	}
+
+	for _, groupID := range missingIDs {
+		if run.stopped() {
+			break
+		}
+		if err := run.request(ctx, groupID); err != nil {
+			log.Error(errors.Wrap(err, fmt.Sprintf("Error publishing message for missing group %s", groupID)))
+		}
 	}
+	return nil
 }
 
-// Request all groups within the configured base folder/prefix
+// Order groups so that those whose last propagations failed are requested
+// first, most failures in any one target first, leaving the rest in their
+// original order.
+func (c *Crawler) prioritizeFailing(gs []groups.Group) {
+	errorCounts := make(map[string]int)
+
+	states, err := c.stateStore.ListGroupStates()
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed listing group states, crawling in the default order"))
+		return
+	}
+	for _, s := range states {
+		if c.targets[s.Target] && s.ErrorCount > errorCounts[s.GroupID] {
+			errorCounts[s.GroupID] = s.ErrorCount
+		}
+	}
+
+	sort.SliceStable(gs, func(i, j int) bool {
+		return errorCounts[gs[i].ID] > errorCounts[gs[j].ID]
+	})
+}
+
+// Request all groups within the mapped folders
 // This handles new groups and existing groups with updated memberships
-// It does not send messages for groups that no longer exist in Grouper
-func (c *Crawler) CrawlGrouperGroups(ctx context.Context) error {
+// Groups that were propagated before but no longer exist in Grouper are also requested, so they're deleted
+// Each group's request carries over who asked for the crawl and how
+// Returns the crawl's progress, which is complete for direct crawls, and a
+// *CrawlError if any group failed
+func (c *Crawler) CrawlGrouperGroups(ctx context.Context, req *Request) (*CrawlProgress, error) {
 	ctx, span := otel.Tracer(otelName).Start(ctx, "CrawlGrouperGroups")
 	defer span.End()
 
-	gs, err := c.groupsClient.ListGroupsByPrefix(ctx, c.groupBaseFolder, c.groupBaseFolder) // same thing passed twice: as prefix for group search and for folder to search within
+	// Use the same rules for the whole crawl, even if they're reloaded part way through.
+	rules := c.rules.Load()
+
+	gs, err := listMappedGroups(ctx, c.groupsClient, rules.Mappings)
 	if err != nil {
-		return errors.Wrap(err, "Failed listing groups by prefix")
+		return nil, errors.Wrap(err, "Failed listing groups by prefix")
 	}
 
-	var overallError error
-	for _, group := range gs.Groups {
-		if group.ID != c.publicGroup {
-			err = c.publishClient.PublishContext(ctx, fmt.Sprintf("index.group.%s", group.ID), []byte{})
+	run := c.startCrawl(ctx, "all mapped folders", rules, req)
+
+	c.prioritizeFailing(gs)
+
+	c.publishGroups(ctx, rules, gs, run)
+
+	// Deleting groups is best left alone if the crawl has given up.
+	if !run.stopped() {
+		err = c.crawlMissingGroups(ctx, rules, gs, run)
+	}
+
+	err = run.finish(err)
+	return run.progress(), err
+}
+
+// Request propagation of each of the given groups the filters allow, until
+// the crawl gives up. Failures count towards the crawl's failures.
+func (c *Crawler) publishGroups(ctx context.Context, rules *Rules, gs []groups.Group, run *crawlRun) {
+	for _, group := range gs {
+		if run.stopped() {
+			return
 		}
-		if err != nil {
+		if !rules.Filter.Allows(group.ID, group.Name) {
+			continue
+		}
+		if err := run.request(ctx, group.ID); err != nil {
 			log.Error(errors.Wrap(err, fmt.Sprintf("Error publishing message for group %s", group.ID)))
-			overallError = err
 		}
 	}
+}
+
+// Request propagation of every mapped group within a Grouper folder,
+// including its subfolders. Unlike a full crawl, groups missing from the
+// folder aren't looked for, since the folder is only part of what's mapped.
+func (c *Crawler) CrawlFolder(ctx context.Context, folder string, req *Request) (*CrawlProgress, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "CrawlFolder")
+	defer span.End()
+
+	rules := c.rules.Load()
+
+	gs, err := c.groupsClient.ListGroupsByPrefix(ctx, folder, folder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed listing groups in %s", folder)
+	}
+
+	run := c.startCrawl(ctx, folder, rules, req)
+
+	var mapped []groups.Group
+	for _, g := range gs.Groups {
+		if mappingFor(rules.Mappings, g.Name) != nil {
+			mapped = append(mapped, g)
+		}
+	}
+	log.WithFields(run.req.fields()).Infof("Requesting propagation of %d mapped groups of the %d in %s", len(mapped), len(gs.Groups), folder)
+
+	c.publishGroups(ctx, rules, mapped, run)
 
-	return overallError
+	err = run.finish(nil)
+	return run.progress(), err
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+func TestCrawlMissingGroupsLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDeletions int
+		held         bool
+	}{
+		{"no limit", 0, false},
+		{"within the limit", 3, false},
+		{"over the limit", 2, true},
+	}
+
+	missing := []string{"g1", "g2", "g3"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, s, stateStore := newTestPropagator(t, newFakeGrouper(), false, SafetyLimits{MaxCrawlDeletions: tt.maxDeletions})
+			for _, id := range missing {
+				s.groups["@grouper-"+id] = []string{"alice"}
+				putPropagated(t, stateStore, id, testFolder+":"+id)
+			}
+
+			c := NewCrawler(p.groupsClient, p.rules, p.targets, nil, stateStore, newCrawlTracker())
+			c.PropagateDirectly(p)
+
+			rules := p.current()
+			run := c.startCrawl(context.Background(), testFolder, rules, nil)
+			err := c.crawlMissingGroups(context.Background(), rules, nil, run)
+			if err = run.finish(err); err != nil {
+				t.Fatal(err)
+			}
+
+			held, err := stateStore.ListHeldChanges()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range missing {
+				state, _ := stateStore.GetGroupState("default", id)
+				if tt.held {
+					if !s.has("@grouper-" + id) {
+						t.Errorf("%s was deleted", id)
+					}
+					if state.LastResult != store.ResultHeld {
+						t.Errorf("%s state = %s, want held", id, state.LastResult)
+					}
+					continue
+				}
+				if s.has("@grouper-" + id) {
+					t.Errorf("%s wasn't deleted", id)
+				}
+				if state.LastResult != store.ResultDeleted {
+					t.Errorf("%s state = %s, want deleted", id, state.LastResult)
+				}
+			}
+
+			want := 0
+			if tt.held {
+				want = len(missing)
+			}
+			if len(held) != want {
+				t.Errorf("%d held changes, want %d", len(held), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/user"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+	"github.com/cyverse-de/group-propagator/config"
+)
+
+// Crawl from the command line, propagating every group in-process and
+// printing the crawl's progress once it's done.
+func crawlCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("crawl", flag.ExitOnError)
+	folder := fs.String("folder", "", "Only crawl the groups in this folder, instead of every mapped folder")
+	dryRun := fs.Bool("dry-run", false, "Report what would change without changing anything")
+	force := fs.Bool("force", false, "Update groups even if their memberships are unchanged")
+	targetNames := fs.String("targets", "", "A comma-separated list of the targets to propagate to, if not all of them")
+	reason := fs.String("reason", "", "Why the crawl is being run, for the logs")
+	workers := fs.Int("workers", cfg.CrawlWorkers, "How many groups to propagate at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return errors.New("--workers must be at least 1")
+	}
+
+	ctx := context.Background()
+
+	gc := groups.NewGroupsClient(cfg.IplantGroupsBase, cfg.IplantGroupsUser, cfg.IplantGroupsPublicGroup)
+	if err := gc.SetGroupsID(ctx); err != nil {
+		return errors.Wrap(err, "Couldn't get group information")
+	}
+
+	initialRules, err := NewRules(cfg, gc, "command line")
+	if err != nil {
+		return err
+	}
+	initialRules.CrawlWorkers = *workers
+	rules := &atomic.Pointer[Rules]{}
+	rules.Store(initialRules)
+
+	stateStore, err := openCommandStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer stateStore.Close()
+
+	targets := NewTargets(cfg)
+	propagator := NewPropagator(gc, rules, targets, stateStore, cfg.MemberCacheTTL, cfg.SkipUnchanged)
+
+	crawler := NewCrawler(gc, rules, targets, nil, stateStore, newCrawlTracker())
+	crawler.PropagateDirectly(propagator)
+
+	req := &Request{
+		RequestID: newRequestID(),
+		Reason:    *reason,
+		DryRun:    *dryRun,
+		Force:     *force,
+	}
+	if u, err := user.Current(); err == nil {
+		req.Requester = u.Username
+	}
+	if *targetNames != "" {
+		req.Targets = strings.Split(*targetNames, ",")
+	}
+	if err = propagator.ValidateRequest(req); err != nil {
+		return err
+	}
+
+	var progress *CrawlProgress
+	if *folder != "" {
+		progress, err = crawler.CrawlFolder(ctx, *folder, req)
+	} else {
+		progress, err = crawler.CrawlGrouperGroups(ctx, req)
+	}
+
+	if progress != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(progress); encErr != nil {
+			return errors.Wrap(encErr, "Failed printing the crawl's progress")
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/broker"
+)
+
+// crawlRun requests propagation of the groups a crawl finds, either by
+// publishing a message for each or by handing them to a pool of workers, and
+// collects the groups that fail.
+type crawlRun struct {
+	crawler *Crawler
+
+	// The request made for each group, carrying the crawl's ID.
+	req *Request
+
+	// Feeds the workers, for direct crawls.
+	groupIDs chan string
+	wg       sync.WaitGroup
+
+	// The crawl gives up once more groups than this fail. Zero never gives up.
+	maxFailures int
+
+	mu       sync.Mutex
+	failures map[string]string
+	aborted  bool
+}
+
+// Start tracking a crawl, and its workers if it's direct. finish must be
+// called once every group has been requested.
+func (c *Crawler) startCrawl(ctx context.Context, scope string, rules *Rules, req *Request) *crawlRun {
+	if req == nil {
+		req = &Request{}
+	}
+	req = req.forCrawledGroup()
+	req.CrawlID = c.crawls.start(scope, req)
+
+	log.WithFields(req.fields()).Infof("Started crawl %s of %s", req.CrawlID, scope)
+
+	run := &crawlRun{
+		crawler:     c,
+		req:         req,
+		maxFailures: rules.Safety.MaxCrawlFailures,
+		failures:    make(map[string]string),
+	}
+	if c.propagator != nil {
+		run.groupIDs = make(chan string)
+		for i := 0; i < rules.CrawlWorkers; i++ {
+			run.wg.Add(1)
+			go run.work(ctx)
+		}
+	}
+	return run
+}
+
+// Propagate groups until there are no more.
+func (r *crawlRun) work(ctx context.Context) {
+	defer r.wg.Done()
+
+	for groupID := range r.groupIDs {
+		skipped, err := r.crawler.propagator.PropagateGroupById(ctx, groupID, r.req)
+		if err != nil {
+			log.WithFields(r.req.fields()).Error(errors.Wrapf(err, "Error propagating group %s", groupID))
+			r.fail(groupID, err)
+		}
+		r.crawler.crawls.record(newCrawlResult(r.req.CrawlID, groupID, skipped, err))
+	}
+}
+
+// Count a group as failed, giving up on the crawl if too many have.
+func (r *crawlRun) fail(groupID string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures[groupID] = err.Error()
+	if r.maxFailures > 0 && len(r.failures) > r.maxFailures && !r.aborted {
+		r.aborted = true
+		log.WithFields(r.req.fields()).Errorf("Giving up on crawl %s after %d groups failed, more than the limit of %d", r.req.CrawlID, len(r.failures), r.maxFailures)
+	}
+}
+
+// Whether the crawl has given up, so no more groups should be requested.
+func (r *crawlRun) stopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+// Request propagation of a group, counting it towards the crawl's progress.
+// Failures are also counted towards the crawl's failures. Errors propagating a
+// group directly are only collected.
+func (r *crawlRun) request(ctx context.Context, groupID string) error {
+	var err error
+
+	if r.groupIDs != nil {
+		select {
+		case <-ctx.Done():
+			err = errors.Wrapf(ctx.Err(), "Crawl stopped before group %s was propagated", groupID)
+		case r.groupIDs <- groupID:
+		}
+	} else {
+		var body []byte
+		body, err = json.Marshal(r.req)
+		if err == nil {
+			err = r.crawler.publishClient.PublishOpts(ctx, crawlGroupKeyPrefix+groupID, body, broker.PublishingOpts{ContentType: "application/json", Priority: r.req.Priority})
+		} else {
+			err = errors.Wrap(err, "Failed encoding request")
+		}
+	}
+
+	r.crawler.crawls.queued(r.req.CrawlID, groupID, err)
+	if err != nil {
+		r.fail(groupID, err)
+	}
+	return err
+}
+
+// Wait for any workers to finish. Returns a *CrawlError summarizing the
+// groups that failed and the given error for the crawl as a whole, if any.
+func (r *crawlRun) finish(crawlErr error) error {
+	if r.groupIDs != nil {
+		close(r.groupIDs)
+		r.wg.Wait()
+		r.crawler.propagator.EndCrawl(r.req.CrawlID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.crawler.crawls.published(r.req.CrawlID, r.aborted)
+
+	if crawlErr == nil && len(r.failures) == 0 {
+		return nil
+	}
+	return &CrawlError{
+		CrawlID:  r.req.CrawlID,
+		Failures: r.failures,
+		Aborted:  r.aborted,
+		Err:      crawlErr,
+	}
+}
+
+// The crawl's progress so far.
+func (r *crawlRun) progress() *CrawlProgress {
+	progress, err := r.crawler.crawls.get(r.req.CrawlID)
+	if err != nil {
+		return nil
+	}
+	return progress
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCrawlRunFail(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures int
+		failed      []string
+		aborted     bool
+	}{
+		{"no limit", 0, []string{"g1", "g2", "g3"}, false},
+		{"at the limit", 2, []string{"g1", "g2"}, false},
+		{"over the limit", 2, []string{"g1", "g2", "g3"}, true},
+		{"same group failing again", 2, []string{"g1", "g2", "g2"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newCrawlTracker()
+			req := &Request{}
+			req.CrawlID = tr.start("iplant:de:prod", req)
+
+			run := &crawlRun{
+				crawler:     &Crawler{crawls: tr},
+				req:         req,
+				maxFailures: tt.maxFailures,
+				failures:    make(map[string]string),
+			}
+			for _, id := range tt.failed {
+				run.fail(id, errors.Errorf("Failed propagating %s", id))
+			}
+
+			if run.stopped() != tt.aborted {
+				t.Errorf("stopped() = %t, want %t", run.stopped(), tt.aborted)
+			}
+
+			var crawlErr *CrawlError
+			if !errors.As(run.finish(nil), &crawlErr) {
+				t.Fatal("finish didn't return a *CrawlError")
+			}
+			if crawlErr.Aborted != tt.aborted || crawlErr.Failures["g1"] != "Failed propagating g1" {
+				t.Errorf("finish returned %+v", crawlErr)
+			}
+			if progress, _ := tr.get(req.CrawlID); progress.Aborted != tt.aborted {
+				t.Errorf("progress aborted = %t, want %t", progress.Aborted, tt.aborted)
+			}
+		})
+	}
+}
+
+func TestCrawlRunFinishWithoutFailures(t *testing.T) {
+	tr := newCrawlTracker()
+	req := &Request{}
+	req.CrawlID = tr.start("iplant:de:prod", req)
+
+	run := &crawlRun{crawler: &Crawler{crawls: tr}, req: req, failures: make(map[string]string)}
+	if err := run.finish(nil); err != nil {
+		t.Errorf("finish() = %v, want nil", err)
+	}
+
+	listErr := errors.New("Failed listing groups")
+	if err := run.finish(listErr); !errors.Is(err, listErr) {
+		t.Errorf("finish(%v) = %v", listErr, err)
+	}
+}
+
+func TestCrawlErrorMessage(t *testing.T) {
+	many := make(map[string]string)
+	for i := 1; i <= crawlErrorsListed+2; i++ {
+		many[fmt.Sprintf("g%d", i)] = "timeout"
+	}
+
+	tests := []struct {
+		name string
+		err  *CrawlError
+		want string
+	}{
+		{
+			"crawl failed",
+			&CrawlError{CrawlID: "c1", Err: errors.New("Failed listing groups")},
+			"Crawl c1 failed: Failed listing groups",
+		},
+		{
+			"groups failed",
+			&CrawlError{CrawlID: "c1", Failures: map[string]string{"g2": "timeout", "g1": "held"}},
+			"Crawl c1 2 groups failed: g1: held; g2: timeout",
+		},
+		{
+			"gave up",
+			&CrawlError{CrawlID: "c1", Failures: map[string]string{"g1": "timeout"}, Aborted: true},
+			"Crawl c1 gave up after 1 groups failed: g1: timeout",
+		},
+		{
+			"crawl and groups failed",
+			&CrawlError{CrawlID: "c1", Failures: map[string]string{"g1": "timeout"}, Err: errors.New("Failed finding missing groups")},
+			"Crawl c1 failed: Failed finding missing groups; 1 groups failed: g1: timeout",
+		},
+		{
+			"more groups failed than are listed",
+			&CrawlError{CrawlID: "c1", Failures: many},
+			"Crawl c1 7 groups failed: g1: timeout; g2: timeout; g3: timeout; g4: timeout; g5: timeout; and 2 more",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+
+	"github.com/cyverse-de/group-propagator/broker"
+)
+
+// The prefix of the routing keys the outcome of each group a crawl requested
+// is published with, so that whichever instance started the crawl can count
+// them however many instances handle its requests.
+const crawlResultKeyPrefix = "group-propagator.crawl-result."
+
+// How many finished crawls to keep the progress of.
+const finishedCrawlsKept = 20
+
+// The outcomes of propagating a group a crawl requested.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeSkipped   = "skipped"
+)
+
+// CrawlResult is the outcome of propagating one group a crawl requested.
+type CrawlResult struct {
+	CrawlID string `json:"crawl_id"`
+	GroupID string `json:"group_id"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CrawlProgress counts the outcomes of the groups a crawl requested.
+type CrawlProgress struct {
+	ID        string     `json:"id"`
+	Scope     string     `json:"scope"`
+	RequestID string     `json:"request_id,omitempty"`
+	Requester string     `json:"requester,omitempty"`
+	DryRun    bool       `json:"dry_run,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	// Whether every group has been requested, so the total is known.
+	Published bool `json:"published"`
+
+	// Whether the crawl gave up requesting groups after too many failed.
+	Aborted bool `json:"aborted,omitempty"`
+
+	Queued    int `json:"queued"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+
+	// Groups whose requests couldn't be published, which are counted as failed.
+	PublishFailed int `json:"publish_failed"`
+
+	// The groups that failed, with why.
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// How many failed groups a CrawlError lists in its message.
+const crawlErrorsListed = 5
+
+// CrawlError summarizes the groups a crawl failed to request or propagate.
+type CrawlError struct {
+	CrawlID string
+
+	// Why each failed group failed, by group ID.
+	Failures map[string]string
+
+	// Whether the crawl gave up after too many groups failed.
+	Aborted bool
+
+	// A failure of the crawl as a whole rather than of any one group.
+	Err error
+}
+
+func (e *CrawlError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Crawl %s", e.CrawlID)
+	if e.Err != nil {
+		fmt.Fprintf(&b, " failed: %s", e.Err)
+		if len(e.Failures) == 0 {
+			return b.String()
+		}
+		b.WriteString(";")
+	}
+	if e.Aborted {
+		b.WriteString(" gave up after")
+	}
+	fmt.Fprintf(&b, " %d groups failed", len(e.Failures))
+
+	ids := make([]string, 0, len(e.Failures))
+	for id := range e.Failures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for i, id := range ids {
+		if i == crawlErrorsListed {
+			fmt.Fprintf(&b, "; and %d more", len(ids)-i)
+			break
+		}
+		sep := "; "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(&b, "%s%s: %s", sep, id, e.Failures[id])
+	}
+	return b.String()
+}
+
+func (e *CrawlError) Unwrap() error {
+	return e.Err
+}
+
+// Whether every queued group has an outcome.
+func (c *CrawlProgress) done() bool {
+	return c.Published && c.Succeeded+c.Skipped+c.Failed-c.PublishFailed >= c.Queued
+}
+
+// crawlTracker follows the progress of the crawls started by this instance.
+type crawlTracker struct {
+	mu     sync.Mutex
+	crawls map[string]*CrawlProgress
+
+	// Finished crawls, oldest first, so the oldest can be forgotten.
+	finished []string
+}
+
+func newCrawlTracker() *crawlTracker {
+	return &crawlTracker{crawls: make(map[string]*CrawlProgress)}
+}
+
+// Start tracking a crawl, returning its ID.
+func (t *crawlTracker) start(scope string, req *Request) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := newRequestID()
+	t.crawls[id] = &CrawlProgress{
+		ID:        id,
+		Scope:     scope,
+		RequestID: req.RequestID,
+		Requester: req.Requester,
+		DryRun:    req.DryRun,
+		Started:   time.Now(),
+		Failures:  make(map[string]string),
+	}
+	return id
+}
+
+// Count a group as queued, or as failed if it couldn't be requested.
+func (t *crawlTracker) queued(id, groupID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.crawls[id]
+	if !ok {
+		return
+	}
+	if err != nil {
+		c.Failed++
+		c.PublishFailed++
+		c.Failures[groupID] = err.Error()
+		return
+	}
+	c.Queued++
+}
+
+// Note that every group the crawl will request has been.
+func (t *crawlTracker) published(id string, aborted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.crawls[id]; ok {
+		c.Published = true
+		c.Aborted = aborted
+		t.finishIfDone(c)
+	}
+}
+
+// Count the outcome of a group. Outcomes of crawls started by other instances
+// are ignored.
+func (t *crawlTracker) record(result CrawlResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.crawls[result.CrawlID]
+	if !ok || c.Finished != nil {
+		return
+	}
+
+	switch result.Outcome {
+	case OutcomeSucceeded:
+		c.Succeeded++
+	case OutcomeSkipped:
+		c.Skipped++
+	default:
+		c.Failed++
+		c.Failures[result.GroupID] = result.Error
+	}
+	t.finishIfDone(c)
+}
+
+func (t *crawlTracker) finishIfDone(c *CrawlProgress) {
+	if c.Finished != nil || !c.done() {
+		return
+	}
+
+	now := time.Now()
+	c.Finished = &now
+	verb := "finished"
+	if c.Aborted {
+		verb = "gave up"
+	}
+	log.Infof("Crawl %s of %s %s in %s: %d queued, %d succeeded, %d failed, %d skipped",
+		c.ID, c.Scope, verb, now.Sub(c.Started).Round(time.Millisecond), c.Queued, c.Succeeded, c.Failed, c.Skipped)
+
+	t.finished = append(t.finished, c.ID)
+	if len(t.finished) > finishedCrawlsKept {
+		delete(t.crawls, t.finished[0])
+		t.finished = t.finished[1:]
+	}
+}
+
+// Get a copy of a crawl's progress.
+func (t *crawlTracker) get(id string) (*CrawlProgress, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.crawls[id]
+	if !ok {
+		return nil, restutils.NewHTTPError(404, fmt.Sprintf("No crawl %s was started by this instance", id))
+	}
+	return copyProgress(c), nil
+}
+
+// List copies of the progress of every crawl, most recently started first.
+func (t *crawlTracker) list() []*CrawlProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	crawls := make([]*CrawlProgress, 0, len(t.crawls))
+	for _, c := range t.crawls {
+		crawls = append(crawls, copyProgress(c))
+	}
+	sort.Slice(crawls, func(i, j int) bool {
+		return crawls[i].Started.After(crawls[j].Started)
+	})
+	return crawls
+}
+
+func copyProgress(c *CrawlProgress) *CrawlProgress {
+	cp := *c
+	cp.Failures = make(map[string]string, len(c.Failures))
+	for k, v := range c.Failures {
+		cp.Failures[k] = v
+	}
+	return &cp
+}
+
+// The outcome of propagating a group, for a crawl's progress.
+func newCrawlResult(crawlID, groupID string, skipped bool, err error) CrawlResult {
+	result := CrawlResult{CrawlID: crawlID, GroupID: groupID, Outcome: OutcomeSucceeded}
+	if err != nil {
+		result.Outcome = OutcomeFailed
+		result.Error = err.Error()
+	} else if skipped {
+		result.Outcome = OutcomeSkipped
+	}
+	return result
+}
+
+// Publish the outcome of a group a crawl requested, for the instance that
+// started the crawl.
+func publishCrawlResult(ctx context.Context, b *broker.Broker, result CrawlResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "Failed encoding crawl result")
+	}
+	return b.PublishOpts(ctx, crawlResultKeyPrefix+result.CrawlID, body, broker.PublishingOpts{ContentType: "application/json"})
+}
+
+// Count a published crawl result. Malformed results are dropped, since
+// there's nothing to retry.
+func (t *crawlTracker) handleResult(ctx context.Context, del amqp.Delivery) {
+	var result CrawlResult
+	if err := json.Unmarshal(del.Body, &result); err != nil {
+		log.Error(errors.Wrapf(err, "Discarding malformed crawl result: %s", del.RoutingKey))
+	} else {
+		t.record(result)
+	}
+
+	if err := del.Ack(false); err != nil {
+		log.Error(errors.Wrapf(err, "Error acking crawl result: %s", del.RoutingKey))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCrawlProgressDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress CrawlProgress
+		done     bool
+	}{
+		{"still publishing", CrawlProgress{Queued: 2, Succeeded: 2}, false},
+		{"nothing requested", CrawlProgress{Published: true}, true},
+		{"results pending", CrawlProgress{Published: true, Queued: 3, Succeeded: 1, Skipped: 1}, false},
+		{"every result in", CrawlProgress{Published: true, Queued: 3, Succeeded: 1, Skipped: 1, Failed: 1}, true},
+		{"publish failures", CrawlProgress{Published: true, Queued: 2, Succeeded: 2, Failed: 1, PublishFailed: 1}, true},
+		{"publish failures with results pending", CrawlProgress{Published: true, Queued: 2, Succeeded: 1, Failed: 1, PublishFailed: 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.done(); got != tt.done {
+				t.Errorf("done() = %t, want %t", got, tt.done)
+			}
+		})
+	}
+}
+
+func TestCrawlTracker(t *testing.T) {
+	tr := newCrawlTracker()
+	id := tr.start("iplant:de:prod", &Request{RequestID: "r1", Requester: "admin"})
+
+	tr.queued(id, "g1", nil)
+	tr.queued(id, "g2", nil)
+	tr.queued(id, "g3", errors.New("channel closed"))
+
+	// Results can arrive before every group has been requested.
+	tr.record(newCrawlResult(id, "g1", false, nil))
+	tr.published(id, false)
+
+	progress, err := tr.get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Finished != nil {
+		t.Fatal("finished with a result pending")
+	}
+	if progress.Queued != 2 || progress.Failed != 1 || progress.PublishFailed != 1 || progress.Failures["g3"] != "channel closed" {
+		t.Errorf("progress = %+v", progress)
+	}
+
+	tr.record(newCrawlResult(id, "g2", true, nil))
+	tr.record(newCrawlResult("another-instances-crawl", "g9", false, nil))
+
+	progress, _ = tr.get(id)
+	if progress.Finished == nil {
+		t.Fatal("not finished once every result was in")
+	}
+	if progress.Succeeded != 1 || progress.Skipped != 1 || progress.Failed != 1 {
+		t.Errorf("progress = %+v", progress)
+	}
+
+	// Redelivered results don't count once the crawl has finished.
+	tr.record(newCrawlResult(id, "g2", false, errors.New("timeout")))
+	if progress, _ = tr.get(id); progress.Failed != 1 || progress.Failures["g2"] != "" {
+		t.Errorf("result counted after finishing: %+v", progress)
+	}
+}
+
+func TestCrawlTrackerForgetsOldCrawls(t *testing.T) {
+	tr := newCrawlTracker()
+
+	var ids []string
+	for i := 0; i < finishedCrawlsKept+2; i++ {
+		id := tr.start("iplant:de:prod", &Request{})
+		tr.published(id, false)
+		ids = append(ids, id)
+	}
+
+	if n := len(tr.list()); n != finishedCrawlsKept {
+		t.Errorf("%d crawls kept, want %d", n, finishedCrawlsKept)
+	}
+	for i, id := range ids {
+		_, err := tr.get(id)
+		if forgotten := i < 2; forgotten != (err != nil) {
+			t.Errorf("crawl %d: get returned %v, want forgotten %t", i, err, forgotten)
+		}
+	}
+}
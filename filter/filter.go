@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"path"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Rule matches Grouper groups. Every field that's set must match; a rule with
+// no fields set matches nothing.
+type Rule struct {
+	// An exact Grouper group ID.
+	ID string `mapstructure:"id" json:"id,omitempty"`
+
+	// An exact Grouper group name, e.g. iplant:de:notprod:users:foo.
+	Name string `mapstructure:"name" json:"name,omitempty"`
+
+	// A glob matched against the Grouper group name, as in path.Match.
+	Glob string `mapstructure:"glob" json:"glob,omitempty"`
+
+	// A regular expression matched against the Grouper group name.
+	Regex string `mapstructure:"regex" json:"regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Validate checks that the rule's glob and regular expression are well formed.
+func (r *Rule) Validate() error {
+	if r.Glob != "" {
+		if _, err := path.Match(r.Glob, ""); err != nil {
+			return errors.Wrapf(err, "Invalid glob %s", r.Glob)
+		}
+	}
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			return errors.Wrapf(err, "Invalid regex %s", r.Regex)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the rule matches a group. The name may be empty if
+// it isn't known, in which case only ID rules can match.
+func (r *Rule) Matches(groupID, groupName string) bool {
+	if r.ID == "" && r.Name == "" && r.Glob == "" && r.Regex == "" {
+		return false
+	}
+
+	if r.ID != "" && r.ID != groupID {
+		return false
+	}
+	if r.Name != "" && r.Name != groupName {
+		return false
+	}
+	if r.Glob != "" {
+		if ok, _ := path.Match(r.Glob, groupName); !ok || groupName == "" {
+			return false
+		}
+	}
+	if r.Regex != "" {
+		re := r.re
+		if re == nil {
+			re = regexp.MustCompile(r.Regex)
+		}
+		if groupName == "" || !re.MatchString(groupName) {
+			return false
+		}
+	}
+	return true
+}
+
+// compile validates rules and compiles their regular expressions ahead of time.
+func compile(rules []Rule) error {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+		if rules[i].Regex != "" {
+			rules[i].re = regexp.MustCompile(rules[i].Regex)
+		}
+	}
+	return nil
+}
+
+// Filter decides which Grouper groups are propagated and which iRODS groups
+// may be changed, so that the crawler and propagator agree.
+type Filter struct {
+	include   []Rule
+	exclude   []Rule
+	protected map[string]bool
+}
+
+// New returns a filter. If include is empty every group not excluded is
+// allowed; otherwise a group must match an include rule and no exclude rule.
+// Protected iRODS groups are never modified or deleted.
+func New(include, exclude []Rule, protectedIRODSGroups []string) (*Filter, error) {
+	f := &Filter{protected: make(map[string]bool)}
+
+	if err := compile(include); err != nil {
+		return nil, errors.Wrap(err, "Invalid include rule")
+	}
+	if err := compile(exclude); err != nil {
+		return nil, errors.Wrap(err, "Invalid exclude rule")
+	}
+	f.include = include
+	f.exclude = exclude
+
+	for _, name := range protectedIRODSGroups {
+		f.protected[name] = true
+	}
+
+	return f, nil
+}
+
+// Exclude adds exclude rules to the filter, such as for groups the service
+// itself knows should never be propagated. It isn't safe to call while the
+// filter is in use.
+func (f *Filter) Exclude(rules ...Rule) error {
+	if err := compile(rules); err != nil {
+		return errors.Wrap(err, "Invalid exclude rule")
+	}
+	f.exclude = append(f.exclude, rules...)
+	return nil
+}
+
+// Allows reports whether a group should be propagated.
+func (f *Filter) Allows(groupID, groupName string) bool {
+	for i := range f.exclude {
+		if f.exclude[i].Matches(groupID, groupName) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for i := range f.include {
+		if f.include[i].Matches(groupID, groupName) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsProtected reports whether an iRODS group must never be modified or deleted.
+func (f *Filter) IsProtected(irodsName string) bool {
+	return f.protected[irodsName]
+}
@@ -0,0 +1,85 @@
+package filter
+
+import "testing"
+
+func TestRuleMatches(t *testing.T) {
+	const (
+		id   = "abc123"
+		name = "iplant:de:courses:bio101"
+	)
+
+	tests := []struct {
+		name      string
+		rule      Rule
+		groupName string
+		matches   bool
+	}{
+		{"empty rule", Rule{}, name, false},
+		{"ID", Rule{ID: id}, name, true},
+		{"other ID", Rule{ID: "other"}, name, false},
+		{"ID without a name", Rule{ID: id}, "", true},
+		{"name", Rule{Name: name}, name, true},
+		{"other name", Rule{Name: "iplant:de:courses:bio102"}, name, false},
+		{"glob", Rule{Glob: "iplant:de:courses:*"}, name, true},
+		{"glob across colons", Rule{Glob: "iplant:de:*"}, name, true},
+		{"glob mismatch", Rule{Glob: "iplant:de:users:*"}, name, false},
+		{"glob without a name", Rule{Glob: "*"}, "", false},
+		{"regex", Rule{Regex: `:bio\d+$`}, name, true},
+		{"regex mismatch", Rule{Regex: `^users:`}, name, false},
+		{"regex without a name", Rule{Regex: `.*`}, "", false},
+		{"every field must match", Rule{ID: id, Glob: "iplant:de:users:*"}, name, false},
+		{"all fields", Rule{ID: id, Name: name, Glob: "iplant:*", Regex: "bio"}, name, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.rule.Matches(id, tt.groupName); got != tt.matches {
+				t.Errorf("%+v.Matches(%q, %q) = %t, want %t", tt.rule, id, tt.groupName, got, tt.matches)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	if err := (&Rule{Glob: "[a-"}).Validate(); err == nil {
+		t.Error("Validate accepted a malformed glob")
+	}
+	if err := (&Rule{Regex: "(a"}).Validate(); err == nil {
+		t.Error("Validate accepted a malformed regex")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := New(
+		[]Rule{{Glob: "iplant:de:courses:*"}},
+		[]Rule{{Name: "iplant:de:courses:staff"}},
+		[]string{"@protected"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Allows("1", "iplant:de:courses:bio101") {
+		t.Error("an included group isn't allowed")
+	}
+	if f.Allows("2", "iplant:de:courses:staff") {
+		t.Error("an excluded group is allowed")
+	}
+	if f.Allows("3", "iplant:de:users:alice") {
+		t.Error("a group that isn't included is allowed")
+	}
+
+	if err = f.Exclude(Rule{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allows("1", "iplant:de:courses:bio101") {
+		t.Error("a group excluded by ID afterwards is still allowed")
+	}
+
+	if !f.IsProtected("@protected") || f.IsProtected("@other") {
+		t.Error("IsProtected doesn't match the protected groups")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+
+	"github.com/cyverse-de/group-propagator/broker"
+)
+
+// The prefix of the routing keys crawls request each group's propagation
+// with, which are consumed from their own queue so that a crawl's backlog
+// doesn't hold up requests from elsewhere.
+const crawlGroupKeyPrefix = "index.crawl.group."
+
+// lanes lets messages from the crawl queue wait while any other message is
+// being handled, so that the other queue is drained first.
+type lanes struct {
+	mu     sync.Mutex
+	urgent int
+
+	// Closed whenever no urgent messages are being handled.
+	idle chan struct{}
+}
+
+func newLanes() *lanes {
+	idle := make(chan struct{})
+	close(idle)
+	return &lanes{idle: idle}
+}
+
+// Start handling an urgent message, returning a function to call when done.
+func (l *lanes) beginUrgent() func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.urgent == 0 {
+		l.idle = make(chan struct{})
+	}
+	l.urgent++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.urgent--
+		if l.urgent == 0 {
+			close(l.idle)
+		}
+	}
+}
+
+// Wait until no urgent messages are being handled.
+func (l *lanes) waitIdle(ctx context.Context) error {
+	l.mu.Lock()
+	idle := l.idle
+	l.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type messageHandler struct {
+	propagator *Propagator
+	crawler    *Crawler
+	broker     *broker.Broker
+	messages   *inflight
+	lanes      *lanes
+}
+
+// Handle a message from the main queue.
+func (h *messageHandler) handleUrgent(ctx context.Context, del amqp.Delivery) {
+	ctx, done, ok := h.messages.begin(ctx)
+	if !ok {
+		requeue(del)
+		return
+	}
+	defer done()
+
+	defer h.lanes.beginUrgent()()
+	h.handle(ctx, del)
+}
+
+// Handle a message from the crawl queue, once the main queue is quiet.
+func (h *messageHandler) handleCrawl(ctx context.Context, del amqp.Delivery) {
+	ctx, done, ok := h.messages.begin(ctx)
+	if !ok {
+		requeue(del)
+		return
+	}
+	defer done()
+
+	if err := h.lanes.waitIdle(ctx); err != nil {
+		requeue(del)
+		return
+	}
+	h.handle(ctx, del)
+}
+
+// Report the outcome of a group a crawl requested. Failures are only reported
+// once they won't be retried.
+func (h *messageHandler) reportCrawlResult(ctx context.Context, req *Request, del amqp.Delivery, err error, result CrawlResult) {
+	if req.CrawlID == "" || (result.Outcome == OutcomeFailed && !del.Redelivered && !failureRecorded(err)) {
+		return
+	}
+	if err := publishCrawlResult(ctx, h.broker, result); err != nil {
+		log.WithFields(req.fields()).Error(errors.Wrap(err, "Failed reporting crawl progress"))
+	}
+}
+
+// Whether a failure is already recorded, such as a target being unavailable
+// or some of a crawl's groups failing, so the next crawl retries it and the
+// message needn't be delivered again. Only a crawl that failed as a whole is
+// worth redelivering.
+func failureRecorded(err error) bool {
+	var (
+		targetErr *TargetError
+		crawlErr  *CrawlError
+	)
+	switch {
+	case errors.As(err, &targetErr):
+		return true
+	case errors.As(err, &crawlErr):
+		return crawlErr.Err == nil
+	}
+	return false
+}
+
+// Leave a message for another instance, or this one once it restarts.
+func requeue(del amqp.Delivery) {
+	if err := del.Nack(false, true); err != nil {
+		log.Error(errors.Wrapf(err, "Error requeueing message: %s", del.RoutingKey))
+	}
+}
+
+func (h *messageHandler) handle(ctx context.Context, del amqp.Delivery) {
+	// A malformed request won't get any better for being redelivered.
+	req, err := ParseRequest(del.Body)
+	if err == nil {
+		err = h.propagator.ValidateRequest(req)
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Discarding message: %s", del.RoutingKey))
+		if err = del.Reject(false); err != nil {
+			log.Error(errors.Wrapf(err, "Error rejecting message: %s", del.RoutingKey))
+		}
+		return
+	}
+
+	log.WithFields(req.fields()).Tracef("Got message: %s", del.RoutingKey)
+	if del.RoutingKey == "index.all" || del.RoutingKey == "index.groups" {
+		_, err = h.crawler.CrawlGrouperGroups(ctx, req)
+	} else if groupID, ok := strings.CutPrefix(del.RoutingKey, "index.group."); ok {
+		_, err = h.propagator.PropagateGroupById(ctx, groupID, req)
+	} else if groupID, ok := strings.CutPrefix(del.RoutingKey, crawlGroupKeyPrefix); ok {
+		var skipped bool
+		skipped, err = h.propagator.PropagateGroupById(ctx, groupID, req)
+		h.reportCrawlResult(ctx, req, del, err, newCrawlResult(req.CrawlID, groupID, skipped, err))
+	} else if groupName, ok := strings.CutPrefix(del.RoutingKey, "index.group-name."); ok {
+		err = h.propagator.PropagateGroupByName(ctx, groupName, req)
+	} else if folder, ok := strings.CutPrefix(del.RoutingKey, "index.folder."); ok {
+		_, err = h.crawler.CrawlFolder(ctx, folder, req)
+	}
+
+	if err != nil {
+		log.WithFields(req.fields()).Error(errors.Wrap(err, "Error handling message"))
+	}
+	if err != nil && !failureRecorded(err) {
+		err = del.Reject(!del.Redelivered)
+	} else {
+		err = del.Ack(false)
+	}
+
+	if err != nil {
+		log.Error(errors.Wrap(err, fmt.Sprintf("Error ack/rejecting message: %s", del.RoutingKey)))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFailureRecorded(t *testing.T) {
+	targetErr := &TargetError{GroupID: "abc123", Failures: map[string]error{"default": errors.New("timeout")}}
+
+	tests := []struct {
+		name     string
+		err      error
+		recorded bool
+	}{
+		{"target error", targetErr, true},
+		{"wrapped target error", errors.Wrap(targetErr, "Failed propagating parent groups"), true},
+		{"crawl with failed groups", &CrawlError{CrawlID: "c1", Failures: map[string]string{"abc123": "timeout"}}, true},
+		{"aborted crawl", &CrawlError{CrawlID: "c1", Failures: map[string]string{"abc123": "timeout"}, Aborted: true}, true},
+		{"failed crawl", &CrawlError{CrawlID: "c1", Err: errors.New("Failed listing groups")}, false},
+		{"failed crawl with failed groups", &CrawlError{CrawlID: "c1", Failures: map[string]string{"abc123": "timeout"}, Err: errors.New("Failed listing groups")}, false},
+		{"other error", errors.New("Failed getting group members"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureRecorded(tt.err); got != tt.recorded {
+				t.Errorf("failureRecorded(%v) = %t, want %t", tt.err, got, tt.recorded)
+			}
+		})
+	}
+}
+
+// Whether waitIdle returns before a short timeout.
+func idleSoon(l *lanes) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	return l.waitIdle(ctx) == nil
+}
+
+func TestLanes(t *testing.T) {
+	l := newLanes()
+	if !idleSoon(l) {
+		t.Fatal("new lanes aren't idle")
+	}
+
+	endFirst := l.beginUrgent()
+	endSecond := l.beginUrgent()
+	if idleSoon(l) {
+		t.Error("idle while urgent messages are being handled")
+	}
+
+	endFirst()
+	if idleSoon(l) {
+		t.Error("idle while an urgent message is still being handled")
+	}
+
+	// A crawl message waiting now is let through once the last urgent one is done.
+	waited := make(chan error, 1)
+	go func() {
+		waited <- l.waitIdle(context.Background())
+	}()
+	endSecond()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting crawl message wasn't let through")
+	}
+
+	// Lanes can go busy again after being idle.
+	endThird := l.beginUrgent()
+	if idleSoon(l) {
+		t.Error("idle while a later urgent message is being handled")
+	}
+	endThird()
+	if !idleSoon(l) {
+		t.Error("not idle after every urgent message was handled")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/cyverse-de/group-propagator/config"
+	"github.com/cyverse-de/group-propagator/naming"
+)
+
+// Mapping propagates the groups within a Grouper folder to iRODS groups named
+// by a template.
+type Mapping struct {
+	Folder string
+	Naming *naming.Template
+
+	// Whether every change to groups in this folder needs review.
+	Sensitive bool
+
+	// The names of the targets to propagate to, or all targets if empty.
+	Targets []string
+}
+
+func NewMappings(cfgs []config.Mapping) ([]*Mapping, error) {
+	var mappings []*Mapping
+	for _, m := range cfgs {
+		t, err := naming.Parse(m.IRODSNameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, &Mapping{
+			Folder:    m.Folder,
+			Naming:    t,
+			Sensitive: m.Sensitive,
+			Targets:   m.Targets,
+		})
+	}
+	return mappings, nil
+}
+
+// Contains reports whether a Grouper group name is within the mapping's folder.
+func (m *Mapping) Contains(groupName string) bool {
+	return strings.HasPrefix(groupName, m.Folder+":")
+}
+
+// Selects reports whether groups in the mapping are propagated to a target.
+func (m *Mapping) Selects(target string) bool {
+	if len(m.Targets) == 0 {
+		return true
+	}
+	for _, t := range m.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingFor returns the mapping with the most specific folder containing a
+// group, or nil if no mapping contains it.
+func mappingFor(mappings []*Mapping, groupName string) *Mapping {
+	var found *Mapping
+	for _, m := range mappings {
+		if m.Contains(groupName) && (found == nil || len(m.Folder) > len(found.Folder)) {
+			found = m
+		}
+	}
+	return found
+}
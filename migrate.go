@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+	"github.com/cyverse-de/group-propagator/config"
+	"github.com/cyverse-de/group-propagator/filter"
+	"github.com/cyverse-de/group-propagator/naming"
+	"github.com/cyverse-de/group-propagator/sink"
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+// migrator moves propagated groups from their current iRODS names to the
+// names given by the configured mappings, e.g. after a template changes.
+type migrator struct {
+	groupsClient *groups.GroupsClient
+	targets      []*Target
+	stateStore   store.Store
+	mappings     []*Mapping
+	filter       *filter.Filter
+
+	// Builds the old names, if they aren't taken from the state store.
+	fromTemplate *naming.Template
+
+	dryRun     bool
+	reportACLs bool
+	deleteOld  bool
+	yes        bool
+	in         *bufio.Reader
+}
+
+// Ask whether to go ahead with something, defaulting to no.
+func (m *migrator) confirm(prompt string) bool {
+	if m.yes {
+		return true
+	}
+
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, err := m.in.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// The name a group is currently propagated to in iRODS, if known.
+func (m *migrator) oldName(g groups.Group, state *store.GroupState) (string, error) {
+	if m.fromTemplate != nil {
+		return m.fromTemplate.Execute(g)
+	}
+	if state != nil && state.LastResult != store.ResultDeleted {
+		return state.IRODSName, nil
+	}
+	return "", nil
+}
+
+func (m *migrator) migrateGroup(ctx context.Context, g groups.Group) error {
+	mapping := mappingFor(m.mappings, g.Name)
+	if mapping == nil {
+		return nil
+	}
+
+	newName, err := mapping.Naming.Execute(g)
+	if err != nil {
+		return err
+	}
+
+	var overallError error
+	for _, t := range m.targets {
+		if !mapping.Selects(t.Name) {
+			continue
+		}
+		if err = m.migrateGroupIn(ctx, t, g, newName); err != nil {
+			log.Error(err)
+			overallError = err
+		}
+	}
+	return overallError
+}
+
+func (m *migrator) migrateGroupIn(ctx context.Context, t *Target, g groups.Group, newName string) error {
+	state, err := m.stateStore.GetGroupState(t.Name, g.ID)
+	if err != nil {
+		return err
+	}
+
+	// The service has already propagated the group under its new name, leaving
+	// only the old group to deal with.
+	if m.fromTemplate == nil && state != nil && state.RenamedFrom != "" && state.IRODSName == newName {
+		return m.deleteRenamedGroup(ctx, t, g, state)
+	}
+
+	oldName, err := m.oldName(g, state)
+	if err != nil {
+		return err
+	}
+	if oldName == "" || oldName == newName {
+		return nil
+	}
+
+	prefix := fmt.Sprintf("%s (%s) in %s: %s -> %s", g.Name, g.ID, t.Name, oldName, newName)
+
+	if m.filter.IsProtected(oldName) || m.filter.IsProtected(newName) {
+		fmt.Printf("%s: skipped, a protected iRODS group is involved\n", prefix)
+		return nil
+	}
+
+	if other, err := m.stateStore.FindGroupByIRODSName(t.Name, newName); err != nil {
+		return err
+	} else if other != nil && other.GroupID != g.ID && other.LastResult != store.ResultDeleted {
+		return errors.Errorf("%s: %s is already used by Grouper group %s (%s)", prefix, newName, other.GroupName, other.GroupID)
+	}
+
+	old, err := t.Sink.ListGroupMembers(ctx, oldName)
+	if restutils.GetStatusCode(err) == 404 {
+		fmt.Printf("%s: skipped, %s doesn't exist\n", prefix, oldName)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "Failed fetching members of %s", oldName)
+	}
+
+	if err = m.reportGroupACLs(ctx, t, prefix, oldName); err != nil {
+		return err
+	}
+
+	if m.dryRun {
+		fmt.Printf("%s: would copy %d members\n", prefix, len(old))
+		return nil
+	}
+
+	if err = applyMembers(ctx, t, newName, old); err != nil {
+		return errors.Wrapf(err, "Failed copying members to %s", newName)
+	}
+	fmt.Printf("%s: copied %d members\n", prefix, len(old))
+
+	// The next propagation reconciles the copied membership with Grouper.
+	if state == nil {
+		state = &store.GroupState{Target: t.Name, GroupID: g.ID}
+	}
+	state.GroupName = g.Name
+	state.IRODSName = newName
+	state.MemberHash = ""
+	state.RenamedFrom = oldName
+	if err = m.stateStore.PutGroupState(state); err != nil {
+		return err
+	}
+
+	// Otherwise the old group is left for a later run with --delete-old.
+	if m.deleteOld {
+		return m.deleteRenamedGroup(ctx, t, g, state)
+	}
+	return nil
+}
+
+// Report the paths whose ACLs reference an iRODS group, if asked to.
+func (m *migrator) reportGroupACLs(ctx context.Context, t *Target, prefix, irodsName string) error {
+	// Only iRODS has ACLs to report.
+	d, ok := t.Sink.(*sink.DataInfo)
+	if !ok || !m.reportACLs {
+		return nil
+	}
+
+	perms, err := d.Client.ListGroupPermissions(ctx, irodsName)
+	if err != nil {
+		return errors.Wrapf(err, "Failed listing permissions granted to %s", irodsName)
+	}
+	for _, p := range perms.Permissions {
+		fmt.Printf("%s: %s has %s permission on %s\n", prefix, irodsName, p.Permission, p.Path)
+	}
+	return nil
+}
+
+// Offer to delete the iRODS group a group was propagated to before the
+// service renamed it.
+func (m *migrator) deleteRenamedGroup(ctx context.Context, t *Target, g groups.Group, state *store.GroupState) error {
+	oldName := state.RenamedFrom
+	prefix := fmt.Sprintf("%s (%s) in %s: %s -> %s", g.Name, g.ID, t.Name, oldName, state.IRODSName)
+
+	if m.filter.IsProtected(oldName) {
+		fmt.Printf("%s: %s is protected and will be kept\n", prefix, oldName)
+		return nil
+	}
+	if err := m.reportGroupACLs(ctx, t, prefix, oldName); err != nil {
+		return err
+	}
+
+	if !m.deleteOld {
+		fmt.Printf("%s: already renamed; %s is left over, and --delete-old deletes it\n", prefix, oldName)
+		return nil
+	}
+	if m.dryRun {
+		fmt.Printf("%s: already renamed; would delete %s\n", prefix, oldName)
+		return nil
+	}
+	if !m.confirm(fmt.Sprintf("Delete %s?", oldName)) {
+		return nil
+	}
+
+	err := t.Sink.DeleteGroup(ctx, oldName)
+	if err != nil && restutils.GetStatusCode(err) != 404 {
+		return errors.Wrapf(err, "Failed deleting %s", oldName)
+	}
+	fmt.Printf("%s: deleted %s\n", prefix, oldName)
+
+	state.RenamedFrom = ""
+	return m.stateStore.PutGroupState(state)
+}
+
+func migrateCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromTemplate := fs.String("from-template", "", "Build old iRODS names with this template instead of reading them from the state store")
+	dryRun := fs.Bool("dry-run", false, "Report what would be migrated without changing anything")
+	reportACLs := fs.Bool("report-acls", false, "Report the paths whose ACLs reference each old iRODS group")
+	deleteOld := fs.Bool("delete-old", false, "Delete each old iRODS group after confirmation")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation before deleting old iRODS groups")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	m := &migrator{
+		groupsClient: groups.NewGroupsClient(cfg.IplantGroupsBase, cfg.IplantGroupsUser, cfg.IplantGroupsPublicGroup),
+		targets:      NewTargets(cfg),
+		dryRun:       *dryRun,
+		reportACLs:   *reportACLs,
+		deleteOld:    *deleteOld,
+		yes:          *yes,
+		in:           bufio.NewReader(os.Stdin),
+	}
+
+	// The new names have to be recorded where the service will find them,
+	// or it would refuse to take over the groups it was just migrated to.
+	if cfg.StatePath == "" {
+		return errors.New("migrate needs state.path to record the new iRODS names")
+	}
+
+	var err error
+	if *fromTemplate != "" {
+		if m.fromTemplate, err = naming.Parse(*fromTemplate); err != nil {
+			return err
+		}
+	}
+
+	if err = m.groupsClient.SetGroupsID(ctx); err != nil {
+		return errors.Wrap(err, "Couldn't get group information")
+	}
+	if m.filter, err = newGroupFilter(cfg, m.groupsClient); err != nil {
+		return errors.Wrap(err, "Couldn't set up group filters")
+	}
+	if m.mappings, err = NewMappings(cfg.Mappings); err != nil {
+		return errors.Wrap(err, "Couldn't set up folder mappings")
+	}
+
+	if m.stateStore, err = openCommandStore(cfg); err != nil {
+		return err
+	}
+	defer m.stateStore.Close()
+
+	gs, err := listMappedGroups(ctx, m.groupsClient, m.mappings)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, g := range gs {
+		if !m.filter.Allows(g.ID, g.Name) {
+			continue
+		}
+		if err = m.migrateGroup(ctx, g); err != nil {
+			log.Error(err)
+			failed++
+		}
+	}
+
+	if err = flushTargets(m.targets); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed migrating %d groups", failed)
+	}
+	return nil
+}
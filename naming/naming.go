@@ -0,0 +1,108 @@
+// Package naming builds iRODS group names from Grouper groups using templates.
+//
+// Templates are text/template strings executed against a groups.Group, so
+// they can use {{.ID}}, {{.IDIndex}}, {{.Name}}, {{.Extension}} and
+// {{.DisplayExtension}}, among others, along with the sanitize and lower
+// functions. For example, "@grouper-{{.ID}}" gives the original opaque names
+// and "course-{{lower .Extension}}" gives readable ones.
+//
+// The result is always sanitized to a legal iRODS name: characters other than
+// letters, digits, underscores, dashes, periods and at signs are replaced with
+// underscores, and names too long for iRODS are shortened with a hash suffix
+// so they remain unique.
+package naming
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+)
+
+// The template used when none is configured, matching the original naming scheme.
+const DefaultTemplate = "@grouper-{{.ID}}"
+
+// The longest name iRODS allows for users and groups.
+const MaxLength = 63
+
+var illegalChars = regexp.MustCompile(`[^A-Za-z0-9_.@-]`)
+
+// Sanitize replaces characters that aren't allowed in iRODS group names with underscores.
+func Sanitize(s string) string {
+	return illegalChars.ReplaceAllString(s, "_")
+}
+
+// shorten truncates names longer than MaxLength, appending part of a hash of
+// the full name so that names differing only after the cut stay distinct.
+func shorten(s string) string {
+	if len(s) <= MaxLength {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	suffix := "-" + hex.EncodeToString(sum[:])[:8]
+	return s[:MaxLength-len(suffix)] + suffix
+}
+
+var funcs = template.FuncMap{
+	"sanitize": Sanitize,
+	"lower":    strings.ToLower,
+}
+
+// Template builds iRODS group names from Grouper groups.
+type Template struct {
+	text string
+	tmpl *template.Template
+}
+
+func Parse(text string) (*Template, error) {
+	if text == "" {
+		return nil, errors.New("iRODS name template must not be empty")
+	}
+
+	tmpl, err := template.New("irods_name").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid iRODS name template %s", text)
+	}
+	return &Template{text: text, tmpl: tmpl}, nil
+}
+
+func (t *Template) String() string {
+	return t.text
+}
+
+// Execute returns the sanitized iRODS group name for a Grouper group.
+func (t *Template) Execute(g groups.Group) (string, error) {
+	var sb strings.Builder
+	if err := t.tmpl.Execute(&sb, g); err != nil {
+		return "", errors.Wrapf(err, "Failed building iRODS name for group %s", g.ID)
+	}
+
+	name := shorten(Sanitize(sb.String()))
+	if name == "" {
+		return "", errors.Errorf("iRODS name template %s produced an empty name for group %s", t.text, g.ID)
+	}
+	return name, nil
+}
+
+var defaultTemplate = mustParse(DefaultTemplate)
+
+func mustParse(text string) *Template {
+	t, err := Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// DefaultName returns the name DefaultTemplate gives a group, which is the
+// name groups had before templates could be configured. The template only
+// uses the ID, so it can't fail.
+func DefaultName(groupID string) string {
+	name, _ := defaultTemplate.Execute(groups.Group{ID: groupID})
+	return name
+}
@@ -0,0 +1,86 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"course-bio101", "course-bio101"},
+		{"@grouper-abc.DEF_123", "@grouper-abc.DEF_123"},
+		{"iplant:de:courses", "iplant_de_courses"},
+		{"Intro to Biology", "Intro_to_Biology"},
+		{"a/b\\c", "a_b_c"},
+		{"café", "caf_"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Sanitize(tt.in); got != tt.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestShorten(t *testing.T) {
+	short := strings.Repeat("a", MaxLength)
+	if got := shorten(short); got != short {
+		t.Errorf("shorten changed a name of the maximum length to %s", got)
+	}
+
+	long := strings.Repeat("a", MaxLength+10)
+	got := shorten(long)
+	if len(got) != MaxLength {
+		t.Errorf("shorten(%s) is %d characters, want %d", long, len(got), MaxLength)
+	}
+	if !strings.HasPrefix(got, strings.Repeat("a", 50)) {
+		t.Errorf("shorten(%s) = %s, which doesn't keep the start of the name", long, got)
+	}
+	if shorten(long) != got {
+		t.Error("shorten isn't stable")
+	}
+
+	other := strings.Repeat("a", MaxLength+9) + "b"
+	if shorten(other) == got {
+		t.Errorf("names differing after the cut both shorten to %s", got)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	g := groups.Group{ID: "abc123", Name: "iplant:de:courses:Bio 101", Extension: "Bio 101"}
+
+	tests := []struct {
+		template, want string
+	}{
+		{DefaultTemplate, "@grouper-abc123"},
+		{"course-{{lower .Extension}}", "course-bio_101"},
+		{"{{.Name}}", "iplant_de_courses_Bio_101"},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := Parse(tt.template)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tt.template, err)
+		}
+		if got, err := tmpl.Execute(g); err != nil || got != tt.want {
+			t.Errorf("Execute(%q) = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+
+	if tmpl, err := Parse("{{.DisplayExtension}}"); err != nil {
+		t.Fatal(err)
+	} else if _, err = tmpl.Execute(g); err == nil {
+		t.Error("Execute of a template producing an empty name succeeded")
+	}
+}
+
+func TestDefaultName(t *testing.T) {
+	if got := DefaultName("abc123"); got != "@grouper-abc123" {
+		t.Errorf("DefaultName(abc123) = %q, want @grouper-abc123", got)
+	}
+}
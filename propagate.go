@@ -2,50 +2,99 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/cyverse-de/go-mod/restutils"
-	"github.com/cyverse-de/group-propagator/client/datainfo"
 	"github.com/cyverse-de/group-propagator/client/groups"
+	"github.com/cyverse-de/group-propagator/naming"
+	"github.com/cyverse-de/group-propagator/store"
 )
 
 // To propagate a group:
 // * Fetch group details and members via iplant-groups
 //   -> get a model.GrouperGroup and model.GrouperGroupMembers, probably
-// * Determine iRODS group name (@grouper-<GrouperGroup.ID>)
-// * Create or update group with proper membership list via data-info, potentially validating users/etc.
+// * Determine iRODS group name from the template of the mapping whose folder contains the group
+// * If enabled, skip the rest if the hash of the membership list matches the last one applied
+// * Create or update group with proper membership list via each data-info target the mapping selects,
+//   tracking and retrying each target separately
+// * If the iRODS name changed, keep the old group for the migrate command to delete once its ACLs have moved
+// * If the membership may have changed, re-propagate any mapped groups that include this group as a member
 
 type Propagator struct {
 	groupsClient *groups.GroupsClient
-	groupPrefix  string
 
-	dataInfoClient *datainfo.DataInfoClient
+	// Replaced when the configuration is reloaded.
+	rules *atomic.Pointer[Rules]
+
+	targets []*Target
+
+	stateStore  store.Store
+	memberCache *memberCache
+
+	// Whether to skip groups whose membership hashes match the last applied.
+	// Only safe when every instance shares the state store.
+	skipUnchanged bool
 }
 
-func NewPropagator(groupsClient *groups.GroupsClient, groupPrefix string, dataInfoClient *datainfo.DataInfoClient) *Propagator {
-	if groupPrefix == "" {
-		groupPrefix = "@grouper-"
+func NewPropagator(groupsClient *groups.GroupsClient, rules *atomic.Pointer[Rules], targets []*Target, stateStore store.Store, memberCacheTTL time.Duration, skipUnchanged bool) *Propagator {
+	return &Propagator{
+		groupsClient:  groupsClient,
+		rules:         rules,
+		targets:       targets,
+		stateStore:    stateStore,
+		memberCache:   newMemberCache(memberCacheTTL),
+		skipUnchanged: skipUnchanged,
 	}
+}
 
-	return &Propagator{
-		groupsClient:   groupsClient,
-		groupPrefix:    groupPrefix,
-		dataInfoClient: dataInfoClient,
+// The rules currently in effect.
+func (p *Propagator) current() *Rules {
+	return p.rules.Load()
+}
+
+// Fetch the members of a group, using the expansions of nested groups cached
+// for the crawl it's part of, if any. Users reached through more than one
+// subgroup are listed once.
+func (p *Propagator) getGroupMembers(ctx context.Context, crawlID, groupName string) ([]string, error) {
+	m, _, err := p.expandGroupMembers(ctx, crawlID, groupName)
+	return uniqueMembers(m), err
+}
+
+// uniqueMembers returns the members with any repeats dropped, in the order
+// they first appear.
+func uniqueMembers(members []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, m := range members {
+		if !seen[m] {
+			seen[m] = true
+			unique = append(unique, m)
+		}
 	}
+	return unique
 }
 
-func (p *Propagator) getGroupMembers(ctx context.Context, groupName string) ([]string, error) {
+// Fetch the members of a group, recursing into member groups. Also returns
+// the IDs of every group nested within it so cache entries can be invalidated.
+func (p *Propagator) expandGroupMembers(ctx context.Context, crawlID, groupName string) ([]string, []string, error) {
 	ctx, span := otel.Tracer(otelName).Start(ctx, "getGroupMembers")
 	defer span.End()
 
-	var m []string
+	var m, nested []string
 
 	members, err := p.groupsClient.GetGroupMembers(ctx, groupName)
 	if err != nil {
-		return m, errors.Wrapf(err, "Failed fetching Grouper group members for %s", groupName)
+		return m, nested, errors.Wrapf(err, "Failed fetching Grouper group members for %s", groupName)
 	}
 
 	for _, member := range members.Members {
@@ -53,73 +102,576 @@ func (p *Propagator) getGroupMembers(ctx context.Context, groupName string) ([]s
 			m = append(m, member.ID)
 		} else if member.SourceID == "g:gsa" {
 			// this is a group that is a member of a group
-			submem, err := p.getGroupMembers(ctx, member.Name)
+			submem, subnested, err := p.getSubgroupMembers(ctx, crawlID, member.ID, member.Name)
 			if err != nil {
-				return m, errors.Wrapf(err, "Failed recursing to fetch members of %s", member.Name)
+				return m, nested, errors.Wrapf(err, "Failed recursing to fetch members of %s", member.Name)
 			}
 			m = append(m, submem...)
+			nested = append(nested, member.ID)
+			nested = append(nested, subnested...)
 		} else {
 			log.Errorf("Could not add group member %+v", member)
 		}
 	}
 
-	return m, nil
+	return m, nested, nil
+}
+
+// Like expandGroupMembers, but for groups nested in other groups, whose
+// expansions are cached.
+func (p *Propagator) getSubgroupMembers(ctx context.Context, crawlID, groupID, groupName string) ([]string, []string, error) {
+	if e, ok := p.memberCache.get(crawlID, groupName); ok {
+		return e.members, e.nested, nil
+	}
+
+	m, nested, err := p.expandGroupMembers(ctx, crawlID, groupName)
+	if err != nil {
+		return m, nested, err
+	}
+
+	p.memberCache.put(crawlID, groupName, groupID, m, nested)
+	return m, nested, nil
+}
+
+// Drop the subgroup expansions cached for a crawl once it's done, and write
+// out anything the targets buffered during it.
+func (p *Propagator) EndCrawl(crawlID string) {
+	p.memberCache.endCrawl(crawlID)
+	flushTargets(p.targets)
+}
+
+// sameMembers reports whether two member lists contain the same users,
+// ignoring order and duplicates. Expanded Grouper memberships list a user
+// once for each subgroup they're in, while iRODS lists them once.
+func sameMembers(a, b []string) bool {
+	as := make(map[string]bool)
+	for _, m := range a {
+		as[m] = true
+	}
+	bs := make(map[string]bool)
+	for _, m := range b {
+		if !as[m] {
+			return false
+		}
+		bs[m] = true
+	}
+	return len(as) == len(bs)
+}
+
+// membersHash returns a stable hash of a member list, independent of order.
+func membersHash(members []string) string {
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, m := range sorted {
+		h.Write([]byte(m))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
 }
 
-func (p *Propagator) PropagateGroupById(ctx context.Context, groupID string) error {
+// Propagate a group, then propagate any groups that include it as a member if
+// its flattened membership may have changed, since their iRODS groups would
+// otherwise be stale until the next crawl. That includes groups that aren't
+// propagated themselves, such as excluded groups or those outside the mapped
+// folders, since nothing is known about their memberships. A nil request
+// propagates as usual. Returns whether the group was skipped rather than
+// propagated.
+func (p *Propagator) PropagateGroupById(ctx context.Context, groupID string, req *Request) (bool, error) {
 	ctx, span := otel.Tracer(otelName).Start(ctx, "PropagateGroupByID")
 	defer span.End()
 
-	// Don't propagate the de-users group.
-	if groupID == p.groupsClient.GroupsID {
-		log.Infof("Skipping a propagation request for the de-users group: %s", groupID)
-		return nil
+	if req == nil {
+		req = &Request{}
 	}
+	span.SetAttributes(
+		attribute.String("request.id", req.RequestID),
+		attribute.String("request.requester", req.Requester),
+		attribute.Bool("request.dry_run", req.DryRun),
+		attribute.Bool("request.force", req.Force),
+	)
 
-	irodsName := fmt.Sprintf("%s%s", p.groupPrefix, groupID)
+	// Any cached expansions that include this group may now be out of date,
+	// unless it's only being requested as part of a crawl, whose expansions
+	// are all fetched after the crawl started.
+	if req.CrawlID == "" {
+		p.memberCache.invalidate(groupID)
+	}
 
-	g, err := p.groupsClient.GetGroupByID(ctx, groupID)
+	changed, skipped, err := p.propagateGroup(ctx, groupID, req)
+	if err != nil || !(changed || skipped) {
+		return skipped, err
+	}
+
+	return skipped, p.propagateParentGroups(ctx, groupID, req.forParentGroup(groupID), map[string]bool{groupID: true})
+}
+
+// Look up a group by its Grouper name and propagate it, for requesters that
+// don't know its ID.
+func (p *Propagator) PropagateGroupByName(ctx context.Context, groupName string, req *Request) error {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "PropagateGroupByName")
+	defer span.End()
+
+	g, err := p.groupsClient.GetGroupByName(ctx, groupName)
 	if restutils.GetStatusCode(err) == 404 {
-		err = p.dataInfoClient.DeleteGroup(ctx, irodsName)
+		// Without an ID there's no way to tell which iRODS groups to delete.
+		return errors.Errorf("Group %s doesn't exist in Grouper", groupName)
+	} else if err != nil {
+		return errors.Wrapf(err, "Failed fetching Grouper group %s by name", groupName)
+	}
+
+	_, err = p.PropagateGroupById(ctx, g.ID, req)
+	return err
+}
+
+// Propagate every mapped group that has the given group as a
+// member, recursing upward through the nesting graph. Groups that aren't
+// mapped are passed through, since they may be members of groups that are.
+// The seen map guards against cycles and groups reachable through more than
+// one path.
+func (p *Propagator) propagateParentGroups(ctx context.Context, groupID string, req *Request, seen map[string]bool) error {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "propagateParentGroups")
+	defer span.End()
+
+	parents, err := p.groupsClient.GetSubjectGroups(ctx, groupID)
+	if restutils.GetStatusCode(err) == 404 {
+		// The group no longer exists, so we can't find what it used to belong to.
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "Failed fetching groups containing %s", groupID)
+	}
+
+	var overallError error
+	for _, parent := range parents.Groups {
+		if seen[parent.ID] {
+			continue
+		}
+		seen[parent.ID] = true
+		p.memberCache.invalidate(parent.ID)
+
+		var (
+			changed bool
+			skipped = true
+			err     error
+		)
+		if mappingFor(p.current().Mappings, parent.Name) != nil {
+			log.Infof("Propagating group %s (%s) because its member group %s changed", parent.Name, parent.ID, groupID)
+			changed, skipped, err = p.propagateGroup(ctx, parent.ID, req)
+		}
+		if err == nil && (changed || skipped) {
+			err = p.propagateParentGroups(ctx, parent.ID, req.forParentGroup(parent.ID), seen)
+		}
 		if err != nil {
-			err = errors.Wrap(err, "Error deleting group")
+			log.Error(errors.Wrapf(err, "Error propagating parent group %s", parent.ID))
+			overallError = err
+		}
+	}
+
+	return overallError
+}
+
+// The targets a mapping propagates to, or every target without a mapping,
+// limited to those the request names.
+func (p *Propagator) targetsFor(m *Mapping, req *Request) []*Target {
+	var targets []*Target
+	for _, t := range p.targets {
+		if (m == nil || m.Selects(t.Name)) && req.selects(t.Name) {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// Load the stored state for a group in a target, starting a fresh record if there is none.
+func (p *Propagator) loadState(target, groupID string) *store.GroupState {
+	state, err := p.stateStore.GetGroupState(target, groupID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed loading state for group %s in %s", groupID, target))
+	}
+	if state == nil {
+		state = &store.GroupState{Target: target, GroupID: groupID}
+	}
+	return state
+}
+
+// Record the outcome of a propagation. Failing to save state is logged rather
+// than returned since the propagation itself has already happened.
+func (p *Propagator) saveState(state *store.GroupState, propagateErr error) {
+	state.LastPropagated = time.Now()
+	if propagateErr != nil {
+		state.LastResult = store.ResultFailed
+		state.LastError = propagateErr.Error()
+		state.ErrorCount++
+	} else {
+		state.LastError = ""
+		state.ErrorCount = 0
+	}
+
+	if err := p.stateStore.PutGroupState(state); err != nil {
+		log.Error(errors.Wrapf(err, "Failed saving state for group %s in %s", state.GroupID, state.Target))
+	}
+}
+
+// Propagate a group to each of the given targets concurrently, retrying
+// failures, so that one target being slow or unavailable doesn't hold up the
+// others. Returns whether any target's iRODS membership changed and whether
+// every target skipped the group, along with a *TargetError if any target
+// failed. Dry runs leave the stored state alone.
+func (p *Propagator) forEachTarget(ctx context.Context, groupID string, targets []*Target, req *Request, fn func(*Target, *store.GroupState) (bool, error)) (bool, bool, error) {
+	type outcome struct {
+		changed bool
+		result  store.Result
+		err     error
+	}
+	outcomes := make([]outcome, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *Target) {
+			defer wg.Done()
+
+			state := p.loadState(t.Name, groupID)
+
+			var changed bool
+			err := t.retry(ctx, func() error {
+				var err error
+				state.HeldReason = ""
+				changed, err = fn(t, state)
+				return err
+			})
+			if !req.DryRun {
+				p.saveState(state, err)
+			}
+			if err == nil && state.LastResult != store.ResultHeld && !req.DryRun {
+				// Whatever was held for this group has been superseded.
+				p.discardHeldChange(t.Name, groupID)
+			}
+
+			outcomes[i] = outcome{changed, state.LastResult, err}
+		}(i, t)
+	}
+	wg.Wait()
+
+	var (
+		anyChanged bool
+		allSkipped = true
+		failures   = make(map[string]error)
+	)
+	for i, o := range outcomes {
+		if o.err != nil {
+			log.Error(errors.Wrapf(o.err, "Failed propagating group %s to %s", groupID, targets[i].Name))
+			failures[targets[i].Name] = o.err
+			allSkipped = false
+			continue
+		}
+		allSkipped = allSkipped && o.result == store.ResultSkipped
+		anyChanged = anyChanged || o.changed
+	}
+
+	if len(failures) > 0 {
+		return anyChanged, allSkipped, &TargetError{GroupID: groupID, Failures: failures}
+	}
+	return anyChanged, allSkipped, nil
+}
+
+// Record the same outcome for a group in each of the given targets, for when
+// propagation stops before reaching any of them.
+func (p *Propagator) recordResult(groupID, groupName string, targets []*Target, req *Request, result store.Result, propagateErr error) {
+	if req.DryRun {
+		return
+	}
+
+	for _, t := range targets {
+		state := p.loadState(t.Name, groupID)
+		if groupName != "" {
+			state.GroupName = groupName
+		}
+		state.HeldReason = ""
+		state.LastResult = result
+		p.saveState(state, propagateErr)
+
+		if propagateErr == nil {
+			p.discardHeldChange(t.Name, groupID)
+		}
+	}
+}
+
+// Double-check that a group iplant-groups reported as missing really is gone
+// before its iRODS groups are deleted, by looking it up by its last known name.
+func (p *Propagator) confirmNotFound(ctx context.Context, groupID, groupName string) error {
+	if !p.current().Safety.VerifyNotFound {
+		return nil
+	}
+
+	var err error
+	if groupName != "" {
+		var g groups.Group
+		g, err = p.groupsClient.GetGroupByName(ctx, groupName)
+		if err == nil && g.ID == groupID {
+			return errors.Errorf("Group %s was not found by ID, but was found by its name %s", groupID, groupName)
+		}
+	} else {
+		// Without a name all we can do is ask again.
+		_, err = p.groupsClient.GetGroupByID(ctx, groupID)
+		if err == nil {
+			return errors.Errorf("Group %s was not found by ID, but was found on a second lookup", groupID)
 		}
-		return err
+	}
+
+	if err != nil && restutils.GetStatusCode(err) != 404 {
+		return errors.Wrapf(err, "Failed verifying that group %s no longer exists", groupID)
+	}
+	return nil
+}
+
+// Propagate a single group to every target its mapping selects, returning
+// whether its membership differed from the iRODS membership in any of them,
+// even if the change was held, and whether it was skipped, such as for being
+// excluded.
+func (p *Propagator) propagateGroup(ctx context.Context, groupID string, req *Request) (bool, bool, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "propagateGroup")
+	defer span.End()
+
+	g, err := p.groupsClient.GetGroupByID(ctx, groupID)
+	if restutils.GetStatusCode(err) == 404 {
+		return p.deleteGroup(ctx, groupID, req)
 	} else if err != nil {
-		return errors.Wrap(err, "Failed fetching Grouper group by ID")
+		err = errors.Wrap(err, "Failed fetching Grouper group by ID")
+		p.recordResult(groupID, "", p.targetsFor(nil, req), req, store.ResultFailed, err)
+		return false, false, err
 	} else if groupID != g.ID {
-		return errors.New(fmt.Sprintf("Fetched Grouper group has an ID of %s, but was fetched using the ID %s", g.ID, groupID))
+		err = errors.New(fmt.Sprintf("Fetched Grouper group has an ID of %s, but was fetched using the ID %s", g.ID, groupID))
+		p.recordResult(groupID, "", p.targetsFor(nil, req), req, store.ResultFailed, err)
+		return false, false, err
+	}
+
+	if !p.current().Filter.Allows(g.ID, g.Name) {
+		log.Infof("Skipping a propagation request for excluded group %s (%s)", g.Name, groupID)
+		p.recordResult(groupID, g.Name, p.targetsFor(nil, req), req, store.ResultSkipped, nil)
+		return false, true, nil
 	}
 
-	irodsMembers, err := p.getGroupMembers(ctx, g.Name)
+	m := mappingFor(p.current().Mappings, g.Name)
+	if m == nil {
+		log.Infof("Skipping a propagation request for group %s (%s), which isn't in a mapped folder", g.Name, groupID)
+		p.recordResult(groupID, g.Name, p.targetsFor(nil, req), req, store.ResultSkipped, nil)
+		return false, true, nil
+	}
+	targets := p.targetsFor(m, req)
+
+	irodsName, err := m.Naming.Execute(g)
 	if err != nil {
-		return errors.Wrap(err, "Failed getting group members")
+		p.recordResult(groupID, g.Name, targets, req, store.ResultFailed, err)
+		return false, false, err
+	}
+
+	irodsMembers, err := p.getGroupMembers(ctx, req.CrawlID, g.Name)
+	if err != nil {
+		err = errors.Wrap(err, "Failed getting group members")
+		p.recordResult(groupID, g.Name, targets, req, store.ResultFailed, err)
+		return false, false, err
+	}
+
+	return p.forEachTarget(ctx, groupID, targets, req, func(t *Target, state *store.GroupState) (bool, error) {
+		state.GroupName = g.Name
+		return p.updateGroup(ctx, t, g, m, irodsName, irodsMembers, state, req)
+	})
+}
+
+// Delete the iRODS groups for a Grouper group that no longer exists. The
+// group's name and mapping come from whatever was last propagated to any
+// target.
+func (p *Propagator) deleteGroup(ctx context.Context, groupID string, req *Request) (bool, bool, error) {
+	var groupName string
+	for _, t := range p.targets {
+		if state := p.loadState(t.Name, groupID); state.GroupName != "" {
+			groupName = state.GroupName
+			break
+		}
+	}
+
+	m := mappingFor(p.current().Mappings, groupName)
+	targets := p.targetsFor(m, req)
+
+	if !p.current().Filter.Allows(groupID, groupName) {
+		log.Infof("Skipping deletion of excluded group %s", groupID)
+		p.recordResult(groupID, groupName, targets, req, store.ResultSkipped, nil)
+		return false, true, nil
+	}
+
+	if err := p.confirmNotFound(ctx, groupID, groupName); err != nil {
+		p.recordResult(groupID, groupName, targets, req, store.ResultFailed, err)
+		return false, false, err
+	}
+
+	return p.forEachTarget(ctx, groupID, targets, req, func(t *Target, state *store.GroupState) (bool, error) {
+		state.GroupName = groupName
+		return p.deleteFromTarget(ctx, t, m, state, req)
+	})
+}
+
+// Delete the iRODS group for a Grouper group that no longer exists from one
+// target. The iRODS name can't be built from the group, so the last
+// propagated name is used, falling back to the original naming scheme.
+func (p *Propagator) deleteFromTarget(ctx context.Context, t *Target, m *Mapping, state *store.GroupState, req *Request) (bool, error) {
+	irodsName := state.IRODSName
+	if irodsName == "" {
+		irodsName = naming.DefaultName(state.GroupID)
+		state.IRODSName = irodsName
+	}
+
+	if p.current().Filter.IsProtected(irodsName) {
+		log.Infof("Skipping deletion of group %s: %s is protected", state.GroupID, irodsName)
+		state.LastResult = store.ResultSkipped
+		return false, nil
+	}
+
+	if state.LastResult == store.ResultDeleted {
+		return false, nil
+	}
+
+	plan := &Plan{Target: t.Name, GroupID: state.GroupID, GroupName: state.GroupName, IRODSName: irodsName, Delete: true}
+	if m != nil && m.Sensitive {
+		return false, p.hold(state, &HeldError{Plan: plan, Reason: "group is in a folder marked as sensitive"}, req)
+	}
+	if held, ok := p.current().Safety.CheckDelete(plan).(*HeldError); ok {
+		return false, p.hold(state, held, req)
+	}
+
+	if req.DryRun {
+		log.WithFields(req.fields()).Infof("Would delete group %s -> %s in %s", state.GroupID, irodsName, t.Name)
+		return true, nil
+	}
+
+	err := t.Sink.DeleteGroup(ctx, irodsName)
+	if err != nil && restutils.GetStatusCode(err) != 404 {
+		return false, errors.Wrapf(err, "Error deleting group %s", irodsName)
+	}
+	state.MemberHash = ""
+	state.LastResult = store.ResultDeleted
+	return true, nil
+}
+
+// Return an error if another live Grouper group is already propagated to an
+// iRODS name in a target, which can happen when templates don't include the group ID.
+func (p *Propagator) checkCollision(target, groupID, irodsName string) error {
+	other, err := p.stateStore.FindGroupByIRODSName(target, irodsName)
+	if err != nil {
+		return errors.Wrap(err, "Failed checking for iRODS name collisions")
+	}
+	if other != nil && other.GroupID != groupID && other.LastResult != store.ResultDeleted {
+		return errors.Errorf("iRODS group %s in %s is already used by Grouper group %s (%s)", irodsName, target, other.GroupName, other.GroupID)
+	}
+	return nil
+}
+
+// Return an error if an iRODS group exists that the Grouper group wasn't
+// propagated to before, since it could be a group someone else created that
+// a template happens to name. That includes the group it was renamed from,
+// which it may be renamed back to. Groups with the original names were
+// created before state was kept, and are always the propagator's.
+func checkTakeover(target string, g groups.Group, irodsName string, state *store.GroupState) error {
+	if state.IRODSName == irodsName || state.RenamedFrom == irodsName || irodsName == naming.DefaultName(g.ID) {
+		return nil
+	}
+	return errors.Errorf("iRODS group %s already exists in %s but wasn't created for Grouper group %s (%s); refusing to take it over", irodsName, target, g.Name, g.ID)
+}
+
+// Create or update the iRODS group for a Grouper group in one target. If the
+// name built from the group has changed since it was last propagated there,
+// the group is created under the new name and the old one is recorded as
+// RenamedFrom. The old group is never deleted here, since that would drop
+// every ACL granted to it; migrate --delete-old does that once they've moved.
+func (p *Propagator) updateGroup(ctx context.Context, t *Target, g groups.Group, m *Mapping, irodsName string, irodsMembers []string, state *store.GroupState, req *Request) (bool, error) {
+	appliedHash := state.MemberHash
+	if req.Force || !p.skipUnchanged {
+		appliedHash = ""
+	}
+	renamed := state.IRODSName != irodsName && state.IRODSName != "" && state.LastResult != store.ResultDeleted
+	if state.IRODSName != irodsName {
+		// The hash was applied to a differently named iRODS group.
+		appliedHash = ""
+	}
+
+	if p.current().Filter.IsProtected(irodsName) {
+		log.Infof("Skipping a propagation request for group %s: %s is protected", g.ID, irodsName)
+		state.LastResult = store.ResultSkipped
+		return false, nil
+	}
+
+	if err := p.checkCollision(t.Name, g.ID, irodsName); err != nil {
+		return false, err
+	}
+
+	// Skip the data-info round trips entirely if this membership was already applied.
+	hash := membersHash(irodsMembers)
+	if appliedHash != "" && appliedHash == hash {
+		log.Debugf("Membership of group %s (%s) is unchanged, skipping update of %s in %s", g.Name, g.ID, irodsName, t.Name)
+		state.LastResult = store.ResultUnchanged
+		return false, nil
 	}
 
 	irodsGroupExists := true
 
-	// Check if group exists/has members, but we don't need to care what members
-	_, err = p.dataInfoClient.ListGroupMembers(ctx, irodsName)
+	existing, err := t.Sink.ListGroupMembers(ctx, irodsName)
 	if restutils.GetStatusCode(err) == 404 {
 		irodsGroupExists = false
 	} else if err != nil {
-		return errors.Wrap(err, "Failed fetching existing iRODS group members")
+		return false, errors.Wrap(err, "Failed fetching existing group members")
+	} else if err = checkTakeover(t.Name, g, irodsName, state); err != nil {
+		return false, err
+	}
+
+	// Only recorded once the new name is known to be usable, since the
+	// takeover check needs the name the group had before.
+	if renamed {
+		if state.RenamedFrom != "" && state.RenamedFrom != irodsName {
+			log.Warnf("Group %s (%s) is being renamed again in %s, so %s from an earlier rename is no longer tracked and must be deleted by hand", g.Name, g.ID, t.Name, state.RenamedFrom)
+		}
+		state.RenamedFrom = state.IRODSName
+	}
+	state.IRODSName = irodsName
+
+	// A held change still counts as a change, since groups containing this
+	// one have their own memberships to bring up to date.
+	plan := NewPlan(t.Name, g.ID, g.Name, irodsName, existing, irodsMembers)
+	if m.Sensitive && (len(plan.Adds) > 0 || len(plan.Removes) > 0) {
+		return true, p.hold(state, &HeldError{Plan: plan, Reason: "group is in a folder marked as sensitive"}, req)
+	}
+	if held, ok := p.current().Safety.CheckUpdate(plan, len(existing)).(*HeldError); ok {
+		return true, p.hold(state, held, req)
+	}
+
+	if req.DryRun {
+		log.WithFields(req.fields()).Infof("Would update group %s (%s) -> %s in %s, adding %d and removing %d members",
+			g.Name, g.ID, irodsName, t.Name, len(plan.Adds), len(plan.Removes))
+		return !irodsGroupExists || len(plan.Adds) > 0 || len(plan.Removes) > 0, nil
 	}
 
 	if !irodsGroupExists {
-		initialGroup, err := p.dataInfoClient.CreateGroup(ctx, irodsName, []string{})
+		err = t.Sink.CreateGroup(ctx, irodsName)
 		if err != nil {
-			return errors.Wrapf(err, "Failed creating group %s (%s) -> %s", g.Name, groupID, initialGroup.Name)
+			return false, errors.Wrapf(err, "Failed creating group %s (%s) -> %s", g.Name, g.ID, irodsName)
 		}
 	}
 
-	finalGroup, err := p.dataInfoClient.UpdateGroupMembers(ctx, irodsName, irodsMembers)
+	err = t.Sink.UpdateGroupMembers(ctx, irodsName, irodsMembers)
 
 	if err != nil {
-		return errors.Wrapf(err, "Failed updating group %s (%s) -> %s with %d members", g.Name, groupID, finalGroup.Name, len(irodsMembers))
+		return false, errors.Wrapf(err, "Failed updating group %s (%s) -> %s with %d members", g.Name, g.ID, irodsName, len(irodsMembers))
 	}
 
-	log.Infof("Updated group %s (%s) -> %s with %d members", g.Name, groupID, finalGroup.Name, len(finalGroup.Members))
+	log.WithFields(req.fields()).Infof("Updated group %s (%s) -> %s in %s with %d members", g.Name, g.ID, irodsName, t.Name, len(irodsMembers))
 
-	return nil
+	state.MemberHash = hash
+	state.LastResult = store.ResultUpdated
+
+	if !irodsGroupExists && state.RenamedFrom != "" {
+		log.Warnf("Renamed group %s (%s) from %s to %s in %s; %s is kept, with its ACLs, until migrate --delete-old deletes it",
+			g.Name, g.ID, state.RenamedFrom, irodsName, t.Name, state.RenamedFrom)
+	}
+
+	return !irodsGroupExists || !sameMembers(existing, irodsMembers), nil
 }
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/go-mod/restutils"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+	"github.com/cyverse-de/group-propagator/filter"
+	"github.com/cyverse-de/group-propagator/naming"
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+func TestMembersHash(t *testing.T) {
+	a := membersHash([]string{"alice", "bob", "carol"})
+
+	if b := membersHash([]string{"carol", "alice", "bob"}); a != b {
+		t.Errorf("hash depends on order: %s != %s", a, b)
+	}
+	if b := membersHash([]string{"alice", "bob"}); a == b {
+		t.Error("hash doesn't change when a member is removed")
+	}
+	if b := membersHash([]string{"alicebob", "carol"}); a == b {
+		t.Error("hash doesn't separate members")
+	}
+	if membersHash(nil) != membersHash([]string{}) {
+		t.Error("nil and empty member lists hash differently")
+	}
+}
+
+func TestSameMembers(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		same bool
+	}{
+		{"equal", []string{"a", "b"}, []string{"a", "b"}, true},
+		{"reordered", []string{"a", "b"}, []string{"b", "a"}, true},
+		{"duplicates", []string{"a", "b", "a"}, []string{"b", "a"}, true},
+		{"both empty", nil, []string{}, true},
+		{"added", []string{"a"}, []string{"a", "b"}, false},
+		{"removed", []string{"a", "b"}, []string{"a"}, false},
+		{"same length", []string{"a", "a"}, []string{"a", "b"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameMembers(tt.a, tt.b); got != tt.same {
+				t.Errorf("sameMembers(%v, %v) = %t, want %t", tt.a, tt.b, got, tt.same)
+			}
+			if got := sameMembers(tt.b, tt.a); got != tt.same {
+				t.Errorf("sameMembers(%v, %v) = %t, want %t", tt.b, tt.a, got, tt.same)
+			}
+		})
+	}
+}
+
+func TestCheckTakeover(t *testing.T) {
+	g := groups.Group{ID: "abc123", Name: "iplant:de:courses:bio101"}
+
+	tests := []struct {
+		name      string
+		irodsName string
+		state     store.GroupState
+		allowed   bool
+	}{
+		{"propagated before", "course-bio101", store.GroupState{IRODSName: "course-bio101"}, true},
+		{"original name", "@grouper-abc123", store.GroupState{}, true},
+		{"never propagated", "course-bio101", store.GroupState{}, false},
+		{"renamed onto an existing group", "course-bio101", store.GroupState{IRODSName: "@grouper-abc123"}, false},
+		{"another group's original name", "@grouper-def456", store.GroupState{}, false},
+		{"renamed back", "course-bio101", store.GroupState{IRODSName: "course-bio-101", RenamedFrom: "course-bio101"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTakeover("default", g, tt.irodsName, &tt.state)
+			if (err == nil) != tt.allowed {
+				t.Errorf("checkTakeover(%s) = %v, want allowed %t", tt.irodsName, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestUniqueMembers(t *testing.T) {
+	got := uniqueMembers([]string{"bob", "alice", "bob", "carol", "alice"})
+	if want := []string{"bob", "alice", "carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uniqueMembers = %v, want %v", got, want)
+	}
+	if got = uniqueMembers(nil); len(got) != 0 {
+		t.Errorf("uniqueMembers(nil) = %v, want none", got)
+	}
+}
+
+// fakeGrouper serves the parts of the iplant-groups API the propagator uses.
+// Groups can be listed by ID and by name separately, to mimic lookups that
+// disagree.
+type fakeGrouper struct {
+	byID    map[string]groups.Group
+	byName  map[string]groups.Group
+	members map[string][]string
+}
+
+func newFakeGrouper() *fakeGrouper {
+	return &fakeGrouper{
+		byID:    make(map[string]groups.Group),
+		byName:  make(map[string]groups.Group),
+		members: make(map[string][]string),
+	}
+}
+
+// Add a group that can be looked up by ID and name, with users as members.
+func (f *fakeGrouper) add(g groups.Group, members ...string) {
+	f.byID[g.ID] = g
+	f.byName[g.Name] = g
+	f.members[g.Name] = members
+}
+
+func (f *fakeGrouper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var (
+		body any
+		ok   bool
+	)
+	switch {
+	case len(parts) == 3 && parts[0] == "groups" && parts[1] == "id":
+		body, ok = f.byID[parts[2]]
+	case len(parts) == 3 && parts[0] == "groups" && parts[2] == "members":
+		var members []string
+		if members, ok = f.members[parts[1]]; ok {
+			gm := groups.GroupMembers{}
+			for _, m := range members {
+				gm.Members = append(gm.Members, groups.Subject{ID: m, SourceID: "ldap"})
+			}
+			body = gm
+		}
+	case len(parts) == 2 && parts[0] == "groups":
+		body, ok = f.byName[parts[1]]
+	case len(parts) == 3 && parts[0] == "subjects" && parts[2] == "groups":
+		body, ok = groups.GroupList{}, true
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// memSink keeps groups in memory.
+type memSink struct {
+	mu     sync.Mutex
+	groups map[string][]string
+}
+
+func newMemSink() *memSink {
+	return &memSink{groups: make(map[string][]string)}
+}
+
+func (s *memSink) Check(ctx context.Context) error {
+	return nil
+}
+
+func (s *memSink) ListGroupMembers(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members, ok := s.groups[name]
+	if !ok {
+		return nil, restutils.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s not found", name))
+	}
+	return members, nil
+}
+
+func (s *memSink) CreateGroup(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups[name] = []string{}
+	return nil
+}
+
+func (s *memSink) UpdateGroupMembers(ctx context.Context, name string, members []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[name]; !ok {
+		return restutils.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s not found", name))
+	}
+	s.groups[name] = members
+	return nil
+}
+
+func (s *memSink) DeleteGroup(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[name]; !ok {
+		return restutils.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s not found", name))
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+func (s *memSink) has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.groups[name]
+	return ok
+}
+
+const testFolder = "iplant:de:prod"
+
+// Set up a propagator for one target backed by the fake sink, propagating
+// groups in testFolder under their original names.
+func newTestPropagator(t *testing.T, grouper *fakeGrouper, sensitive bool, safety SafetyLimits) (*Propagator, *memSink, *store.MemoryStore) {
+	t.Helper()
+
+	server := httptest.NewServer(grouper)
+	t.Cleanup(server.Close)
+
+	tmpl, err := naming.Parse(naming.DefaultTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupFilter, err := filter.New(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := &atomic.Pointer[Rules]{}
+	rules.Store(&Rules{
+		Mappings:     []*Mapping{{Folder: testFolder, Naming: tmpl, Sensitive: sensitive}},
+		Filter:       groupFilter,
+		Safety:       safety,
+		CrawlWorkers: 1,
+	})
+
+	s := newMemSink()
+	stateStore := store.NewMemoryStore()
+	gc := groups.NewGroupsClient(server.URL, "grouper", "de-users")
+	p := NewPropagator(gc, rules, []*Target{{Name: "default", Sink: s}}, stateStore, time.Minute, false)
+	return p, s, stateStore
+}
+
+// Record a group as having been propagated to the default target before.
+func putPropagated(t *testing.T, stateStore store.Store, groupID, groupName string) {
+	t.Helper()
+
+	err := stateStore.PutGroupState(&store.GroupState{
+		Target:     "default",
+		GroupID:    groupID,
+		GroupName:  groupName,
+		IRODSName:  "@grouper-" + groupID,
+		LastResult: store.ResultUpdated,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateGroupHoldsRemovals(t *testing.T) {
+	existing := []string{"u0", "u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8", "u9"}
+
+	tests := []struct {
+		name      string
+		sensitive bool
+		safety    SafetyLimits
+		desired   []string
+		held      bool
+	}{
+		{"within limits", false, SafetyLimits{MaxRemovalPercent: 50}, existing[:6], false},
+		{"too large a share removed", false, SafetyLimits{MaxRemovalPercent: 50}, existing[:2], true},
+		{"group smaller than the minimum size", false, SafetyLimits{MaxRemovalPercent: 50, MinGroupSize: 20}, existing[:2], false},
+		{"too many removed", false, SafetyLimits{MaxRemovals: 3}, existing[:6], true},
+		{"sensitive group", false, SafetyLimits{SensitiveGroups: []string{"g1"}}, existing[:9], true},
+		{"sensitive folder", true, SafetyLimits{}, existing[:9], true},
+		{"sensitive folder without changes", true, SafetyLimits{}, existing, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grouper := newFakeGrouper()
+			grouper.add(groups.Group{ID: "g1", Name: testFolder + ":course"}, tt.desired...)
+
+			p, s, stateStore := newTestPropagator(t, grouper, tt.sensitive, tt.safety)
+			s.groups["@grouper-g1"] = existing
+			putPropagated(t, stateStore, "g1", testFolder+":course")
+
+			if _, err := p.PropagateGroupById(context.Background(), "g1", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			state, _ := stateStore.GetGroupState("default", "g1")
+			change, _ := stateStore.GetHeldChange("default", "g1")
+			members, _ := s.ListGroupMembers(context.Background(), "@grouper-g1")
+
+			if tt.held {
+				if state.LastResult != store.ResultHeld || state.HeldReason == "" {
+					t.Errorf("state = %s (%q), want held with a reason", state.LastResult, state.HeldReason)
+				}
+				if change == nil {
+					t.Fatal("no held change saved")
+				}
+				if !sameMembers(change.Members, tt.desired) {
+					t.Errorf("held change members = %v, want %v", change.Members, tt.desired)
+				}
+				if !sameMembers(members, existing) {
+					t.Errorf("held group was changed to %v", members)
+				}
+				return
+			}
+
+			if state.LastResult == store.ResultHeld || change != nil {
+				t.Errorf("change was held: %s", state.HeldReason)
+			}
+			if !sameMembers(members, tt.desired) {
+				t.Errorf("members = %v, want %v", members, tt.desired)
+			}
+		})
+	}
+}
+
+func TestDeleteFromTargetSensitive(t *testing.T) {
+	tests := []struct {
+		name      string
+		sensitive bool
+		safety    SafetyLimits
+		held      bool
+	}{
+		{"ordinary group", false, SafetyLimits{}, false},
+		{"sensitive by ID", false, SafetyLimits{SensitiveGroups: []string{"g1"}}, true},
+		{"sensitive by name", false, SafetyLimits{SensitiveGroups: []string{testFolder + ":course"}}, true},
+		{"sensitive folder", true, SafetyLimits{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, s, stateStore := newTestPropagator(t, newFakeGrouper(), tt.sensitive, tt.safety)
+			s.groups["@grouper-g1"] = []string{"alice"}
+			putPropagated(t, stateStore, "g1", testFolder+":course")
+
+			if _, err := p.PropagateGroupById(context.Background(), "g1", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			state, _ := stateStore.GetGroupState("default", "g1")
+			change, _ := stateStore.GetHeldChange("default", "g1")
+
+			if tt.held {
+				if !s.has("@grouper-g1") {
+					t.Error("held group was deleted")
+				}
+				if state.LastResult != store.ResultHeld || change == nil || !change.Delete {
+					t.Errorf("state = %s, held change = %+v, want a held deletion", state.LastResult, change)
+				}
+				return
+			}
+
+			if s.has("@grouper-g1") {
+				t.Error("group wasn't deleted")
+			}
+			if state.LastResult != store.ResultDeleted || change != nil {
+				t.Errorf("state = %s, held change = %+v, want deleted", state.LastResult, change)
+			}
+		})
+	}
+}
+
+func TestConfirmNotFound(t *testing.T) {
+	tests := []struct {
+		name    string
+		verify  bool
+		byName  *groups.Group
+		deleted bool
+	}{
+		{"not verified", false, &groups.Group{ID: "g1", Name: testFolder + ":course"}, true},
+		{"gone", true, nil, true},
+		{"found by name", true, &groups.Group{ID: "g1", Name: testFolder + ":course"}, false},
+		{"name reused by another group", true, &groups.Group{ID: "g2", Name: testFolder + ":course"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grouper := newFakeGrouper()
+			if tt.byName != nil {
+				grouper.byName[tt.byName.Name] = *tt.byName
+			}
+
+			p, s, stateStore := newTestPropagator(t, grouper, false, SafetyLimits{VerifyNotFound: tt.verify})
+			s.groups["@grouper-g1"] = []string{"alice"}
+			putPropagated(t, stateStore, "g1", testFolder+":course")
+
+			_, err := p.PropagateGroupById(context.Background(), "g1", nil)
+			if tt.deleted != (err == nil) {
+				t.Errorf("err = %v, want deleted %t", err, tt.deleted)
+			}
+			if s.has("@grouper-g1") == tt.deleted {
+				t.Errorf("group exists = %t, want deleted %t", s.has("@grouper-g1"), tt.deleted)
+			}
+		})
+	}
+}
+
+func TestPropagateGroupByIdInvalidatesOutsideCrawls(t *testing.T) {
+	tests := []struct {
+		name    string
+		crawlID string
+		kept    bool
+	}{
+		{"outside a crawl", "", false},
+		{"in a crawl", "c1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grouper := newFakeGrouper()
+			grouper.add(groups.Group{ID: "sub", Name: "iplant:de:other:sub"}, "alice")
+
+			p, _, _ := newTestPropagator(t, grouper, false, SafetyLimits{})
+			p.memberCache.put("c1", "iplant:de:other:sub", "sub", []string{"alice"}, nil)
+
+			if _, err := p.PropagateGroupById(context.Background(), "sub", &Request{CrawlID: tt.crawlID}); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := p.memberCache.get("c1", "iplant:de:other:sub"); ok != tt.kept {
+				t.Errorf("crawl's entry kept = %t, want %t", ok, tt.kept)
+			}
+		})
+	}
+}
+
+func TestUpdateGroupRenamedBack(t *testing.T) {
+	grouper := newFakeGrouper()
+	grouper.add(groups.Group{ID: "g1", Name: testFolder + ":a", Extension: "a"}, "alice", "bob")
+
+	p, s, stateStore := newTestPropagator(t, grouper, false, SafetyLimits{})
+	tmpl, err := naming.Parse("course-{{.Extension}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.current().Mappings[0].Naming = tmpl
+
+	// The group was renamed from course-a to course-b, and its template now
+	// gives course-a again.
+	s.groups["course-a"] = []string{"alice"}
+	s.groups["course-b"] = []string{"alice"}
+	err = stateStore.PutGroupState(&store.GroupState{
+		Target:      "default",
+		GroupID:     "g1",
+		GroupName:   testFolder + ":a",
+		IRODSName:   "course-b",
+		RenamedFrom: "course-a",
+		LastResult:  store.ResultUpdated,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = p.PropagateGroupById(context.Background(), "g1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := stateStore.GetGroupState("default", "g1")
+	if state.IRODSName != "course-a" || state.RenamedFrom != "course-b" {
+		t.Errorf("state has IRODSName %s and RenamedFrom %s, want course-a and course-b", state.IRODSName, state.RenamedFrom)
+	}
+	if members, _ := s.ListGroupMembers(context.Background(), "course-a"); !sameMembers(members, []string{"alice", "bob"}) {
+		t.Errorf("course-a members = %v, want alice and bob", members)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyverse-de/configurate"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/client/groups"
+	"github.com/cyverse-de/group-propagator/config"
+	"github.com/cyverse-de/group-propagator/filter"
+)
+
+// Rules are the settings that can change while the service runs: which
+// groups are propagated, where to and under what names, the safety limits
+// and how many workers direct crawls use. They're replaced as a whole when the configuration is reloaded,
+// never changed in place.
+type Rules struct {
+	// Identifies the configuration file contents the rules came from.
+	Version  string
+	LoadedAt time.Time
+
+	// Whether the configuration changes settings that only take effect
+	// after a restart.
+	RestartPending bool
+
+	Mappings     []*Mapping
+	Filter       *filter.Filter
+	Safety       SafetyLimits
+	CrawlWorkers int
+}
+
+// Build the rules from a configuration. The groups client must already have
+// looked up the de-users group ID.
+func NewRules(cfg *config.Config, gc *groups.GroupsClient, version string) (*Rules, error) {
+	groupFilter, err := newGroupFilter(cfg, gc)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't set up group filters")
+	}
+
+	mappings, err := NewMappings(cfg.Mappings)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't set up folder mappings")
+	}
+
+	return &Rules{
+		Version:  version,
+		LoadedAt: time.Now(),
+		Mappings: mappings,
+		Filter:   groupFilter,
+		Safety: SafetyLimits{
+			MaxRemovalPercent: cfg.SafetyMaxRemovalPercent,
+			MinGroupSize:      cfg.SafetyMinGroupSize,
+			MaxRemovals:       cfg.SafetyMaxRemovals,
+			MaxCrawlDeletions: cfg.SafetyMaxCrawlDeletions,
+			MaxCrawlFailures:  cfg.SafetyMaxCrawlFailures,
+			VerifyNotFound:    cfg.SafetyVerifyNotFound,
+			SensitiveGroups:   cfg.SafetySensitiveGroups,
+		},
+		CrawlWorkers: cfg.CrawlWorkers,
+	}, nil
+}
+
+// A short hash of the configuration file, or "defaults" if there isn't one.
+func configVersion(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "defaults", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "Failed reading %s", path)
+	}
+
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:6]), nil
+}
+
+// Load and validate the configuration file, merged over the defaults.
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := configurate.InitDefaults(path, defaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	return config.NewFromViper(cfg)
+}
+
+// Clear the settings that are applied by a reload, leaving those that need a restart.
+func restartSettings(c config.Config) config.Config {
+	c.IplantGroupsFolderNamePrefix = ""
+	c.Mappings = nil
+	c.FilterInclude = nil
+	c.FilterExclude = nil
+	c.ProtectedIRODSGroups = nil
+	c.SafetyMaxRemovalPercent = 0
+	c.SafetyMinGroupSize = 0
+	c.SafetyMaxRemovals = 0
+	c.SafetyMaxCrawlDeletions = 0
+	c.SafetyMaxCrawlFailures = 0
+	c.SafetyVerifyNotFound = false
+	c.SafetySensitiveGroups = nil
+	c.CrawlWorkers = 0
+	return c
+}
+
+// ConfigWatcher reloads the rules when the configuration file changes. A
+// configuration that fails to load or validate is logged and ignored, leaving
+// the previous rules in effect.
+type ConfigWatcher struct {
+	path         string
+	rules        *atomic.Pointer[Rules]
+	groupsClient *groups.GroupsClient
+
+	// The configuration the service started with. Settings that need a
+	// restart keep these values until then, so each reload is compared with
+	// it rather than the last configuration applied.
+	started *config.Config
+}
+
+func NewConfigWatcher(path string, rules *atomic.Pointer[Rules], groupsClient *groups.GroupsClient, started *config.Config) *ConfigWatcher {
+	return &ConfigWatcher{
+		path:         path,
+		rules:        rules,
+		groupsClient: groupsClient,
+		started:      started,
+	}
+}
+
+func (w *ConfigWatcher) reload() {
+	version, err := configVersion(w.path)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed reloading configuration, keeping the previous version"))
+		return
+	}
+	previous := w.rules.Load()
+	if version == previous.Version {
+		return
+	}
+
+	cfg, err := loadConfig(w.path)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Configuration version %s is invalid, keeping version %s", version, previous.Version))
+		return
+	}
+
+	rules, err := NewRules(cfg, w.groupsClient, version)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Configuration version %s is invalid, keeping version %s", version, previous.Version))
+		return
+	}
+
+	if !reflect.DeepEqual(restartSettings(*w.started), restartSettings(*cfg)) {
+		rules.RestartPending = true
+		log.Warnf("Configuration version %s changes settings that only take effect after a restart", version)
+	}
+
+	w.rules.Store(rules)
+	log.Infof("Applied configuration version %s, replacing version %s", version, previous.Version)
+}
+
+// Watch the configuration file until the context is cancelled. The directory
+// is watched rather than the file, since Kubernetes updates mounted secrets
+// and config maps by swapping a symlink.
+func (w *ConfigWatcher) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Failed creating a file watcher")
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(filepath.Dir(w.path)); err != nil {
+		return errors.Wrapf(err, "Failed watching %s", filepath.Dir(w.path))
+	}
+
+	// Changes tend to arrive as bursts of events, so wait for them to settle.
+	const settle = time.Second
+	timer := time.NewTimer(settle)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Events:
+			timer.Reset(settle)
+		case err = <-watcher.Errors:
+			log.Error(errors.Wrap(err, "Error watching the configuration file"))
+		case <-timer.C:
+			w.reload()
+		}
+	}
+}
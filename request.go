@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The highest priority AMQP supports.
+const maxPriority = 9
+
+// Request is the optional JSON body of a propagation message, saying who asked
+// for it and why, and how to go about it. An empty body is an empty request,
+// which propagates as messages always have.
+type Request struct {
+	RequestID string `json:"request_id,omitempty"`
+	Requester string `json:"requester,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+
+	// Work out and log what would change without changing anything.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Update iRODS even if the membership matches what was last applied.
+	Force bool `json:"force,omitempty"`
+
+	// From 0 to 9, as with AMQP message priorities.
+	Priority uint8 `json:"priority,omitempty"`
+
+	// The targets to propagate to, out of those the group's mapping selects.
+	// Empty means all of them.
+	Targets []string `json:"targets,omitempty"`
+
+	// Set on the requests a crawl makes for each group, to count their
+	// outcomes towards its progress.
+	CrawlID string `json:"crawl_id,omitempty"`
+}
+
+// ParseRequest reads a message body, giving the request an ID if it has none
+// so that everything done for it can be traced back to it.
+func ParseRequest(body []byte) (*Request, error) {
+	req := &Request{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, req); err != nil {
+			return nil, errors.Wrap(err, "Failed parsing the message body as a request")
+		}
+	}
+
+	if req.Priority > maxPriority {
+		return nil, errors.Errorf("Request priority %d is more than %d", req.Priority, maxPriority)
+	}
+
+	if req.RequestID == "" {
+		req.RequestID = newRequestID()
+	}
+	return req, nil
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(errors.Wrap(err, "Failed generating a request ID"))
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// The request to make for each group found by a crawl, which carries over
+// everything from the request for the crawl. Its priority orders it among
+// other crawls' requests.
+func (r *Request) forCrawledGroup() *Request {
+	sub := *r
+	if sub.Reason == "" {
+		sub.Reason = "crawl"
+	}
+	return &sub
+}
+
+// The request to propagate a group's parents with after it changed. Only the
+// group asked for is forced.
+func (r *Request) forParentGroup(groupID string) *Request {
+	sub := *r
+	sub.Force = false
+	sub.CrawlID = ""
+	sub.Reason = fmt.Sprintf("member group %s changed", groupID)
+	return &sub
+}
+
+// Whether the request limits propagation to a target.
+func (r *Request) selects(target string) bool {
+	if len(r.Targets) == 0 {
+		return true
+	}
+	for _, t := range r.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Request) fields() logrus.Fields {
+	fields := logrus.Fields{"request_id": r.RequestID}
+	if r.Requester != "" {
+		fields["requester"] = r.Requester
+	}
+	if r.Reason != "" {
+		fields["reason"] = r.Reason
+	}
+	if r.DryRun {
+		fields["dry_run"] = true
+	}
+	if r.Force {
+		fields["force"] = true
+	}
+	if r.CrawlID != "" {
+		fields["crawl_id"] = r.CrawlID
+	}
+	return fields
+}
+
+// Check that every target a request names is configured.
+func (p *Propagator) ValidateRequest(req *Request) error {
+	for _, name := range req.Targets {
+		if _, err := p.target(name); err != nil {
+			return restutils.NewHTTPError(400, fmt.Sprintf("Request %s names unknown target %s", req.RequestID, name))
+		}
+	}
+	return nil
+}
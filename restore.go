@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/config"
+	"github.com/cyverse-de/group-propagator/filter"
+	"github.com/cyverse-de/group-propagator/sink"
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+// restorer reapplies group memberships from a snapshot written by a file
+// target, such as to roll back after a bad crawl.
+type restorer struct {
+	target     *Target
+	stateStore store.Store
+	filter     *filter.Filter
+	dryRun     bool
+}
+
+func (r *restorer) restoreGroup(ctx context.Context, g sink.FileGroup) error {
+	if r.filter.IsProtected(g.Name) {
+		fmt.Printf("%s: skipped, protected\n", g.Name)
+		return nil
+	}
+
+	existing, err := r.target.Sink.ListGroupMembers(ctx, g.Name)
+	exists := true
+	if restutils.GetStatusCode(err) == 404 {
+		exists = false
+	} else if err != nil {
+		return errors.Wrapf(err, "Failed fetching members of %s", g.Name)
+	}
+
+	plan := NewPlan(r.target.Name, "", "", g.Name, existing, g.Members)
+	if exists && len(plan.Adds) == 0 && len(plan.Removes) == 0 {
+		return nil
+	}
+
+	var diff []string
+	if !exists {
+		diff = append(diff, "create")
+	}
+	for _, m := range plan.Adds {
+		diff = append(diff, "+"+m)
+	}
+	for _, m := range plan.Removes {
+		diff = append(diff, "-"+m)
+	}
+
+	if r.dryRun {
+		fmt.Printf("%s: would apply %s\n", g.Name, strings.Join(diff, " "))
+		return nil
+	}
+
+	if err = applyMembers(ctx, r.target, g.Name, g.Members); err != nil {
+		return err
+	}
+	fmt.Printf("%s: applied %s\n", g.Name, strings.Join(diff, " "))
+
+	// Record what's now applied, so the next propagation compares Grouper
+	// against the restored membership.
+	state, err := r.stateStore.FindGroupByIRODSName(r.target.Name, g.Name)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		state.MemberHash = membersHash(g.Members)
+		if err = r.stateStore.PutGroupState(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreCommand(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Report the changes a restore would make without making them")
+	targetName := fs.String("target", "", "The target to restore to, required if more than one is configured")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return errors.New("restore requires a snapshot")
+	}
+
+	gs, err := sink.ReadSnapshot(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Any further arguments limit the restore to those groups.
+	only := make(map[string]bool)
+	for _, name := range fs.Args()[1:] {
+		only[name] = true
+	}
+
+	r := &restorer{dryRun: *dryRun}
+
+	// Guessing could restore a snapshot into the file target it came from.
+	targets := NewTargets(cfg)
+	if *targetName == "" {
+		if len(targets) > 1 {
+			return errors.New("restore needs --target when more than one target is configured")
+		}
+		*targetName = targets[0].Name
+	}
+	for _, t := range targets {
+		if t.Name == *targetName {
+			r.target = t
+		}
+	}
+	if r.target == nil {
+		return errors.Errorf("No target is named %s", *targetName)
+	}
+
+	if r.filter, err = filter.New(cfg.FilterInclude, cfg.FilterExclude, cfg.ProtectedIRODSGroups); err != nil {
+		return errors.Wrap(err, "Couldn't set up group filters")
+	}
+
+	if r.stateStore, err = openCommandStore(cfg); err != nil {
+		return err
+	}
+	defer r.stateStore.Close()
+
+	ctx := context.Background()
+
+	var failed int
+	for _, g := range gs {
+		if len(only) > 0 && !only[g.Name] {
+			continue
+		}
+		if err = r.restoreGroup(ctx, g); err != nil {
+			log.Error(err)
+			failed++
+		}
+	}
+
+	if err = flushTargets([]*Target{r.target}); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed restoring %d groups", failed)
+	}
+	return nil
+}
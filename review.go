@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+
+	"github.com/cyverse-de/group-propagator/store"
+)
+
+// Persist a held change for review, replacing any earlier one for the same group.
+func holdChange(stateStore store.Store, held *HeldError) error {
+	change := &store.HeldChange{
+		Target:    held.Plan.Target,
+		GroupID:   held.Plan.GroupID,
+		GroupName: held.Plan.GroupName,
+		IRODSName: held.Plan.IRODSName,
+		Adds:      held.Plan.Adds,
+		Removes:   held.Plan.Removes,
+		Delete:    held.Plan.Delete,
+		Members:   held.Plan.Members,
+		Reason:    held.Reason,
+		HeldAt:    time.Now(),
+	}
+	return stateStore.PutHeldChange(change)
+}
+
+// Hold a change for review and mark the group's state accordingly. The change
+// isn't an error as far as the caller is concerned unless it couldn't be saved.
+// Dry runs only report what would be held.
+func (p *Propagator) hold(state *store.GroupState, held *HeldError, req *Request) error {
+	if req.DryRun {
+		log.WithFields(req.fields()).Infof("Would hold: %s", held)
+		state.LastResult = store.ResultHeld
+		return nil
+	}
+
+	log.Warn(held)
+
+	if err := holdChange(p.stateStore, held); err != nil {
+		return errors.Wrap(err, "Failed holding change for review")
+	}
+
+	state.LastResult = store.ResultHeld
+	state.HeldReason = held.Reason
+	return nil
+}
+
+func (p *Propagator) discardHeldChange(target, groupID string) {
+	if err := p.stateStore.DeleteHeldChange(target, groupID); err != nil {
+		log.Error(errors.Wrapf(err, "Failed discarding held change for group %s in %s", groupID, target))
+	}
+}
+
+// Look up a configured target by name.
+func (p *Propagator) target(name string) (*Target, error) {
+	for _, t := range p.targets {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, restutils.NewHTTPError(404, fmt.Sprintf("No target is named %s", name))
+}
+
+// The target held changes are reviewed in when none is given.
+func (p *Propagator) DefaultTarget() string {
+	if len(p.targets) == 0 {
+		return store.DefaultTarget
+	}
+	return p.targets[0].Name
+}
+
+func (p *Propagator) getHeldChange(target, groupID string) (*store.HeldChange, error) {
+	change, err := p.stateStore.GetHeldChange(target, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if change == nil {
+		return nil, restutils.NewHTTPError(404, fmt.Sprintf("No change is held for group %s in %s", groupID, target))
+	}
+	return change, nil
+}
+
+// Apply a held change exactly as it was stored, then remove it from review.
+func (p *Propagator) ApplyHeldChange(ctx context.Context, target, groupID string) (*store.HeldChange, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "ApplyHeldChange")
+	defer span.End()
+
+	t, err := p.target(target)
+	if err != nil {
+		return nil, err
+	}
+
+	change, err := p.getHeldChange(target, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.current().Filter.IsProtected(change.IRODSName) {
+		return nil, restutils.NewHTTPError(403, fmt.Sprintf("%s is protected and can't be changed", change.IRODSName))
+	}
+
+	state := p.loadState(target, groupID)
+	state.IRODSName = change.IRODSName
+	state.HeldReason = ""
+
+	if change.Delete {
+		err = t.Sink.DeleteGroup(ctx, change.IRODSName)
+		if restutils.GetStatusCode(err) == 404 {
+			err = nil
+		}
+		if err == nil {
+			state.MemberHash = ""
+			state.LastResult = store.ResultDeleted
+		}
+	} else {
+		// Changes held before members were deduplicated may repeat some.
+		change.Members = uniqueMembers(change.Members)
+		err = applyMembers(ctx, t, change.IRODSName, change.Members)
+		if err == nil {
+			state.MemberHash = membersHash(change.Members)
+			state.LastResult = store.ResultUpdated
+		}
+	}
+	p.saveState(state, err)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed applying held change for group %s in %s", groupID, target)
+	}
+
+	p.memberCache.invalidate(groupID)
+	p.discardHeldChange(target, groupID)
+
+	log.Infof("Applied held change for group %s (%s) -> %s in %s", change.GroupName, groupID, change.IRODSName, target)
+	return change, nil
+}
+
+// Discard a held change without applying it. The group will be held again the
+// next time it's propagated if the same limits are still exceeded.
+func (p *Propagator) RejectHeldChange(target, groupID string) (*store.HeldChange, error) {
+	change, err := p.getHeldChange(target, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.stateStore.DeleteHeldChange(target, groupID); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Rejected held change for group %s (%s) -> %s in %s", change.GroupName, groupID, change.IRODSName, target)
+	return change, nil
+}
+
+// Set the membership of a group in a target, creating the group if necessary.
+func applyMembers(ctx context.Context, t *Target, irodsName string, members []string) error {
+	_, err := t.Sink.ListGroupMembers(ctx, irodsName)
+	if restutils.GetStatusCode(err) == 404 {
+		err = t.Sink.CreateGroup(ctx, irodsName)
+		if err != nil {
+			return errors.Wrapf(err, "Failed creating group %s", irodsName)
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "Failed fetching existing group members")
+	}
+
+	err = t.Sink.UpdateGroupMembers(ctx, irodsName, members)
+	if err != nil {
+		return errors.Wrapf(err, "Failed updating group %s with %d members", irodsName, len(members))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+)
+
+// SafetyLimits bound how much access a single propagation or crawl may take
+// away, guarding against iplant-groups returning empty or missing groups.
+// Zero values disable the corresponding check.
+type SafetyLimits struct {
+	// The largest percentage of an iRODS group's members that may be removed
+	// in one update. Only applies when removing more than one member from a
+	// group of at least MinGroupSize members, since ordinary edits to small
+	// groups remove a large share of them.
+	MaxRemovalPercent float64
+	MinGroupSize      int
+
+	// The largest number of members that may be removed in one update.
+	MaxRemovals int
+
+	// The largest number of groups a crawl may delete.
+	MaxCrawlDeletions int
+
+	// The largest number of groups that may fail before a crawl gives up.
+	MaxCrawlFailures int
+
+	// Whether to look a group up a second time, by name, before deleting it.
+	VerifyNotFound bool
+
+	// IDs or names of Grouper groups whose changes always need review.
+	SensitiveGroups []string
+}
+
+// IsSensitive reports whether a group is listed as sensitive by ID or name.
+func (l SafetyLimits) IsSensitive(groupID, groupName string) bool {
+	for _, s := range l.SensitiveGroups {
+		if s == groupID || (groupName != "" && s == groupName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan describes the changes a propagation would make to an iRODS group.
+type Plan struct {
+	Target    string
+	GroupID   string
+	GroupName string
+	IRODSName string
+
+	Adds    []string
+	Removes []string
+	Delete  bool
+
+	// The full membership the iRODS group should end up with.
+	Members []string
+}
+
+// NewPlan works out the adds and removes needed to go from the existing
+// iRODS membership to the desired one.
+func NewPlan(target, groupID, groupName, irodsName string, existing, desired []string) *Plan {
+	p := &Plan{
+		Target:    target,
+		GroupID:   groupID,
+		GroupName: groupName,
+		IRODSName: irodsName,
+		Members:   desired,
+	}
+
+	existingSet := make(map[string]bool)
+	for _, m := range existing {
+		existingSet[m] = true
+	}
+	desiredSet := make(map[string]bool)
+	for _, m := range desired {
+		desiredSet[m] = true
+		if !existingSet[m] {
+			p.Adds = append(p.Adds, m)
+		}
+	}
+	for _, m := range existing {
+		if !desiredSet[m] {
+			p.Removes = append(p.Removes, m)
+		}
+	}
+
+	return p
+}
+
+// HeldError is returned when a change is blocked by the safety limits and
+// needs review before it's applied.
+type HeldError struct {
+	Plan   *Plan
+	Reason string
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("Change to %s in %s held for review: %s", e.Plan.IRODSName, e.Plan.Target, e.Reason)
+}
+
+// CheckDelete returns a *HeldError if the plan deletes a sensitive group.
+func (l SafetyLimits) CheckDelete(plan *Plan) error {
+	if l.IsSensitive(plan.GroupID, plan.GroupName) {
+		return &HeldError{Plan: plan, Reason: "group is marked as sensitive"}
+	}
+	return nil
+}
+
+// CheckUpdate returns a *HeldError if the plan changes a sensitive group or
+// removes more members from existingCount than the limits allow.
+func (l SafetyLimits) CheckUpdate(plan *Plan, existingCount int) error {
+	removals := len(plan.Removes)
+
+	if l.IsSensitive(plan.GroupID, plan.GroupName) && (len(plan.Adds) > 0 || removals > 0) {
+		return &HeldError{Plan: plan, Reason: "group is marked as sensitive"}
+	}
+
+	if l.MaxRemovals > 0 && removals > l.MaxRemovals {
+		return &HeldError{
+			Plan:   plan,
+			Reason: fmt.Sprintf("would remove %d members, more than the limit of %d", removals, l.MaxRemovals),
+		}
+	}
+
+	if l.MaxRemovalPercent > 0 && removals > 1 && existingCount > 0 && existingCount >= l.MinGroupSize {
+		percent := 100 * float64(removals) / float64(existingCount)
+		if percent > l.MaxRemovalPercent {
+			return &HeldError{
+				Plan:   plan,
+				Reason: fmt.Sprintf("would remove %d of %d members (%.0f%%), more than the limit of %.0f%%", removals, existingCount, percent, l.MaxRemovalPercent),
+			}
+		}
+	}
+
+	return nil
+}
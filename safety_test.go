@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		desired  []string
+		adds     []string
+		removes  []string
+	}{
+		{"unchanged", []string{"a", "b"}, []string{"b", "a"}, nil, nil},
+		{"adds", []string{"a"}, []string{"a", "b", "c"}, []string{"b", "c"}, nil},
+		{"removes", []string{"a", "b", "c"}, []string{"b"}, nil, []string{"a", "c"}},
+		{"both", []string{"a", "b"}, []string{"b", "c"}, []string{"c"}, []string{"a"}},
+		{"new group", nil, []string{"a"}, []string{"a"}, nil},
+		{"emptied", []string{"a", "b"}, nil, nil, []string{"a", "b"}},
+		{"duplicate desired members", []string{"a"}, []string{"a", "b", "b"}, []string{"b", "b"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPlan("default", "id", "name", "irods", tt.existing, tt.desired)
+			if !reflect.DeepEqual(p.Adds, tt.adds) {
+				t.Errorf("Adds = %v, want %v", p.Adds, tt.adds)
+			}
+			if !reflect.DeepEqual(p.Removes, tt.removes) {
+				t.Errorf("Removes = %v, want %v", p.Removes, tt.removes)
+			}
+			if !reflect.DeepEqual(p.Members, tt.desired) {
+				t.Errorf("Members = %v, want %v", p.Members, tt.desired)
+			}
+		})
+	}
+}
+
+// members returns n distinct member names.
+func members(n int) []string {
+	var m []string
+	for i := 0; i < n; i++ {
+		m = append(m, string(rune('a'+i)))
+	}
+	return m
+}
+
+func TestCheckUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   SafetyLimits
+		existing []string
+		desired  []string
+		held     bool
+	}{
+		{"no limits", SafetyLimits{}, members(10), nil, false},
+		{"under max removals", SafetyLimits{MaxRemovals: 3}, members(10), members(8), false},
+		{"at max removals", SafetyLimits{MaxRemovals: 3}, members(10), members(7), false},
+		{"over max removals", SafetyLimits{MaxRemovals: 3}, members(10), members(6), true},
+		{"at max percent", SafetyLimits{MaxRemovalPercent: 50}, members(10), members(5), false},
+		{"over max percent", SafetyLimits{MaxRemovalPercent: 50}, members(10), members(4), true},
+		{"emptying a group", SafetyLimits{MaxRemovalPercent: 50}, members(4), nil, true},
+		{"a single removal is always allowed", SafetyLimits{MaxRemovalPercent: 10}, members(2), members(1), false},
+		{"under min group size", SafetyLimits{MaxRemovalPercent: 50, MinGroupSize: 10}, members(3), members(1), false},
+		{"at min group size", SafetyLimits{MaxRemovalPercent: 50, MinGroupSize: 10}, members(10), members(4), true},
+		{"max removals ignore min group size", SafetyLimits{MaxRemovals: 1, MinGroupSize: 10}, members(3), members(1), true},
+		{"adds don't count", SafetyLimits{MaxRemovals: 1, MaxRemovalPercent: 10}, members(2), members(10), false},
+		{"new group", SafetyLimits{MaxRemovalPercent: 50}, nil, members(3), false},
+		{"sensitive by ID", SafetyLimits{SensitiveGroups: []string{"id"}}, members(2), members(3), true},
+		{"sensitive by name", SafetyLimits{SensitiveGroups: []string{"name"}}, members(3), members(2), true},
+		{"sensitive but unchanged", SafetyLimits{SensitiveGroups: []string{"id"}}, members(3), members(3), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPlan("default", "id", "name", "irods", tt.existing, tt.desired)
+			err := tt.limits.CheckUpdate(p, len(tt.existing))
+			if held, ok := err.(*HeldError); ok != tt.held {
+				t.Errorf("CheckUpdate = %v, want held %t", err, tt.held)
+			} else if ok && held.Plan != p {
+				t.Errorf("HeldError has plan %+v, want %+v", held.Plan, p)
+			}
+		})
+	}
+}
+
+func TestCheckDelete(t *testing.T) {
+	limits := SafetyLimits{SensitiveGroups: []string{"sensitive"}}
+
+	if err := limits.CheckDelete(&Plan{GroupID: "id", GroupName: "name", Delete: true}); err != nil {
+		t.Errorf("CheckDelete of an ordinary group = %v, want nil", err)
+	}
+	if _, ok := limits.CheckDelete(&Plan{GroupID: "id", GroupName: "sensitive", Delete: true}).(*HeldError); !ok {
+		t.Error("CheckDelete of a sensitive group wasn't held")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// inflight tracks the messages being handled, so that shutdown can wait for
+// them to finish. Once draining starts, no more are accepted.
+type inflight struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+
+	// Cancelled if draining runs out of time, to abandon what's left.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newInflight() *inflight {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &inflight{ctx: ctx, cancel: cancel}
+}
+
+// Start handling a message, returning a context that's cancelled if draining
+// runs out of time and a function to call when done. Returns false if
+// draining has started, in which case the message should be requeued.
+func (f *inflight) begin(ctx context.Context) (context.Context, func(), bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.draining {
+		return ctx, nil, false
+	}
+	f.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(f.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		f.wg.Done()
+	}, true
+}
+
+// Stop accepting messages and wait for those being handled to finish, up to
+// the timeout, after which they're cancelled.
+func (f *inflight) drain(timeout time.Duration) error {
+	f.mu.Lock()
+	f.draining = true
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		f.cancel()
+		return errors.Errorf("Messages were still being handled after %s", timeout)
+	}
+}
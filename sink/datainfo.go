@@ -0,0 +1,39 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/cyverse-de/group-propagator/client/datainfo"
+)
+
+// DataInfo writes groups to iRODS through data-info.
+type DataInfo struct {
+	Client *datainfo.DataInfoClient
+}
+
+func NewDataInfo(client *datainfo.DataInfoClient) *DataInfo {
+	return &DataInfo{Client: client}
+}
+
+func (d *DataInfo) Check(ctx context.Context) error {
+	return d.Client.Check(ctx)
+}
+
+func (d *DataInfo) ListGroupMembers(ctx context.Context, name string) ([]string, error) {
+	g, err := d.Client.ListGroupMembers(ctx, name)
+	return g.Members, err
+}
+
+func (d *DataInfo) CreateGroup(ctx context.Context, name string) error {
+	_, err := d.Client.CreateGroup(ctx, name, []string{})
+	return err
+}
+
+func (d *DataInfo) UpdateGroupMembers(ctx context.Context, name string, members []string) error {
+	_, err := d.Client.UpdateGroupMembers(ctx, name, members)
+	return err
+}
+
+func (d *DataInfo) DeleteGroup(ctx context.Context, name string) error {
+	return d.Client.DeleteGroup(ctx, name)
+}
@@ -0,0 +1,441 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+)
+
+// The formats a file sink can write.
+const (
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// The file a jsonl sink keeps every group in.
+const snapshotFile = "snapshot.jsonl"
+
+// How long a jsonl sink waits after a change before rewriting the snapshot,
+// so that a burst of changes such as a crawl's is written once rather than
+// once per group.
+const snapshotWriteDelay = 5 * time.Second
+
+// FileOptions configures where and how a file sink writes groups.
+type FileOptions struct {
+	Dir string `mapstructure:"dir"`
+
+	// json or csv write a file per group; jsonl writes every group to a
+	// single snapshot.jsonl, one per line. The snapshot is rewritten in full
+	// and held in memory, so large deployments should use a per-group format.
+	Format string `mapstructure:"format"`
+}
+
+func (o *FileOptions) Validate() error {
+	if o.Dir == "" {
+		return errors.New("dir must be set")
+	}
+
+	switch o.Format {
+	case FormatJSON, FormatCSV, FormatJSONL:
+	default:
+		return errors.Errorf("format must be %s, %s or %s", FormatJSON, FormatCSV, FormatJSONL)
+	}
+	return nil
+}
+
+// FileGroup is a group as a file sink writes it. Members are sorted so that
+// snapshots can be diffed between runs.
+type FileGroup struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// File writes group memberships to files, replacing each file atomically so
+// readers never see a partial write.
+type File struct {
+	Options FileOptions
+
+	// Guards the single snapshot, which every group shares. It's read on
+	// first use and kept in memory, and changes are written out
+	// snapshotWriteDelay after the first unwritten one, or by Flush.
+	mu      sync.Mutex
+	groups  map[string][]string
+	pending *time.Timer
+}
+
+func NewFile(options FileOptions) *File {
+	return &File{Options: options}
+}
+
+func fileNotFound(name string) error {
+	return restutils.NewHTTPError(404, fmt.Sprintf("No file is written for group %s", name))
+}
+
+// The path of the file for a group, for the per-group formats.
+func (f *File) groupPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", errors.Errorf("Group name %s can't be used as a file name", name)
+	}
+	return filepath.Join(f.Options.Dir, name+"."+f.Options.Format), nil
+}
+
+// Write a file by writing a temporary file in the same directory and renaming it over the original.
+func writeAtomically(path string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "Failed creating %s", filepath.Dir(path))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "Failed creating a temporary file for %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err = write(w); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		// CreateTemp makes files only the owner can read.
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed writing %s", path)
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "Failed replacing %s", path)
+	}
+	return nil
+}
+
+// The members sorted, with any repeats dropped.
+func sortedMembers(members []string) []string {
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	return slices.Compact(sorted)
+}
+
+func (f *File) readGroup(name string) ([]string, error) {
+	path, err := f.groupPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fileNotFound(name)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed opening %s", path)
+	}
+	defer file.Close()
+
+	return decodeGroup(file, path, f.Options.Format)
+}
+
+// Decode the members in a per-group file.
+func decodeGroup(r io.Reader, path, format string) ([]string, error) {
+	if format == FormatCSV {
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed reading %s", path)
+		}
+
+		var members []string
+		for i, r := range records {
+			if i > 0 && len(r) > 0 {
+				members = append(members, r[0])
+			}
+		}
+		return members, nil
+	}
+
+	var g FileGroup
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, errors.Wrapf(err, "Failed reading %s", path)
+	}
+	return g.Members, nil
+}
+
+func (f *File) writeGroup(name string, members []string) error {
+	path, err := f.groupPath(name)
+	if err != nil {
+		return err
+	}
+
+	return writeAtomically(path, func(w io.Writer) error {
+		if f.Options.Format == FormatCSV {
+			cw := csv.NewWriter(w)
+			if err := cw.Write([]string{"member"}); err != nil {
+				return err
+			}
+			for _, m := range sortedMembers(members) {
+				if err := cw.Write([]string{m}); err != nil {
+					return err
+				}
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(FileGroup{Name: name, Members: sortedMembers(members)})
+	})
+}
+
+// Read every group in the snapshot. A missing snapshot has no groups.
+func (f *File) readSnapshot() (map[string][]string, error) {
+	groups := make(map[string][]string)
+
+	gs, err := readSnapshotFile(filepath.Join(f.Options.Dir, snapshotFile))
+	if os.IsNotExist(errors.Cause(err)) {
+		return groups, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, g := range gs {
+		groups[g.Name] = g.Members
+	}
+	return groups, nil
+}
+
+func readSnapshotFile(path string) ([]FileGroup, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed opening %s", path)
+	}
+	defer file.Close()
+
+	var gs []FileGroup
+	dec := json.NewDecoder(file)
+	for dec.More() {
+		var g FileGroup
+		if err = dec.Decode(&g); err != nil {
+			return nil, errors.Wrapf(err, "Failed reading %s", path)
+		}
+		gs = append(gs, g)
+	}
+	return gs, nil
+}
+
+// ReadSnapshot reads the groups a file sink wrote, from either a jsonl
+// snapshot or a directory of per-group json or csv files.
+func ReadSnapshot(path string) ([]FileGroup, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading %s", path)
+	}
+	if !info.IsDir() {
+		return readSnapshotFile(path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed listing %s", path)
+	}
+
+	var gs []FileGroup
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || (ext != "."+FormatJSON && ext != "."+FormatCSV) {
+			continue
+		}
+
+		groupPath := filepath.Join(path, e.Name())
+		file, err := os.Open(groupPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed opening %s", groupPath)
+		}
+		members, err := decodeGroup(file, groupPath, ext[1:])
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		gs = append(gs, FileGroup{Name: strings.TrimSuffix(e.Name(), ext), Members: members})
+	}
+
+	if len(gs) == 0 {
+		return readSnapshotFile(filepath.Join(path, snapshotFile))
+	}
+	return gs, nil
+}
+
+// Rewrite the snapshot with every group, sorted by name.
+func (f *File) writeSnapshot(groups map[string][]string) error {
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return writeAtomically(filepath.Join(f.Options.Dir, snapshotFile), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, name := range names {
+			if err := enc.Encode(FileGroup{Name: name, Members: sortedMembers(groups[name])}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The groups in the snapshot, read from the file on first use. The caller
+// must hold mu.
+func (f *File) snapshot() (map[string][]string, error) {
+	if f.groups == nil {
+		groups, err := f.readSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		f.groups = groups
+	}
+	return f.groups, nil
+}
+
+// Write the snapshot out after snapshotWriteDelay, unless a write is already
+// pending. The caller must hold mu.
+func (f *File) scheduleWrite() {
+	if f.pending != nil {
+		return
+	}
+	f.pending = time.AfterFunc(snapshotWriteDelay, func() {
+		if err := f.Flush(); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// Change the snapshot. If the change function returns an error, the snapshot
+// is left as it was and the error is returned as is.
+func (f *File) updateSnapshot(change func(map[string][]string) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groups, err := f.snapshot()
+	if err != nil {
+		return err
+	}
+	if err = change(groups); err != nil {
+		return err
+	}
+	f.scheduleWrite()
+	return nil
+}
+
+// Flush writes the snapshot if it has changes that haven't been written yet.
+// A failed write is tried again later.
+func (f *File) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pending == nil {
+		return nil
+	}
+	f.pending.Stop()
+	f.pending = nil
+
+	if err := f.writeSnapshot(f.groups); err != nil {
+		f.scheduleWrite()
+		return err
+	}
+	return nil
+}
+
+func (f *File) Check(ctx context.Context) error {
+	if err := os.MkdirAll(f.Options.Dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed creating %s", f.Options.Dir)
+	}
+	return nil
+}
+
+func (f *File) ListGroupMembers(ctx context.Context, name string) ([]string, error) {
+	_, span := otel.Tracer(otelName).Start(ctx, "ListGroupMembers")
+	defer span.End()
+
+	if f.Options.Format != FormatJSONL {
+		return f.readGroup(name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groups, err := f.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	members, ok := groups[name]
+	if !ok {
+		return nil, fileNotFound(name)
+	}
+	return append([]string{}, members...), nil
+}
+
+func (f *File) CreateGroup(ctx context.Context, name string) error {
+	return f.UpdateGroupMembers(ctx, name, []string{})
+}
+
+func (f *File) UpdateGroupMembers(ctx context.Context, name string, members []string) error {
+	_, span := otel.Tracer(otelName).Start(ctx, "UpdateGroupMembers")
+	defer span.End()
+
+	if f.Options.Format != FormatJSONL {
+		return f.writeGroup(name, members)
+	}
+
+	return f.updateSnapshot(func(groups map[string][]string) error {
+		groups[name] = members
+		return nil
+	})
+}
+
+func (f *File) DeleteGroup(ctx context.Context, name string) error {
+	_, span := otel.Tracer(otelName).Start(ctx, "DeleteGroup")
+	defer span.End()
+
+	if f.Options.Format != FormatJSONL {
+		path, err := f.groupPath(name)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			return fileNotFound(name)
+		} else if err != nil {
+			return errors.Wrapf(err, "Failed removing %s", path)
+		}
+		return nil
+	}
+
+	return f.updateSnapshot(func(groups map[string][]string) error {
+		if _, ok := groups[name]; !ok {
+			return fileNotFound(name)
+		}
+		delete(groups, name)
+		return nil
+	})
+}
@@ -0,0 +1,68 @@
+package sink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/go-mod/restutils"
+)
+
+func TestFileJSONLBuffersWrites(t *testing.T) {
+	ctx := context.Background()
+	f := NewFile(FileOptions{Dir: t.TempDir(), Format: FormatJSONL})
+	path := filepath.Join(f.Options.Dir, snapshotFile)
+
+	if err := f.UpdateGroupMembers(ctx, "course-bio102", []string{"carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.UpdateGroupMembers(ctx, "course-bio101", []string{"bob", "alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot was written before a flush: %v", err)
+	}
+
+	members, err := f.ListGroupMembers(ctx, "course-bio101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []string{"bob", "alice", "bob"}) {
+		t.Errorf("buffered members = %v, want [bob alice bob]", members)
+	}
+
+	if err = f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	gs, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileGroup{
+		{Name: "course-bio101", Members: []string{"alice", "bob"}},
+		{Name: "course-bio102", Members: []string{"carol"}},
+	}
+	if !reflect.DeepEqual(gs, want) {
+		t.Errorf("snapshot = %+v, want %+v", gs, want)
+	}
+
+	// A new sink reads the snapshot back.
+	f = NewFile(f.Options)
+	if err = f.DeleteGroup(ctx, "course-bio102"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.DeleteGroup(ctx, "course-bio102"); restutils.GetStatusCode(err) != 404 {
+		t.Errorf("deleting a deleted group = %v, want a 404", err)
+	}
+	if err = f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if gs, err = ReadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gs, want[:1]) {
+		t.Errorf("snapshot after deletion = %+v, want %+v", gs, want[:1])
+	}
+}
@@ -0,0 +1,338 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+)
+
+// The LDAP object classes groups can be written as.
+const (
+	GroupOfNames = "groupOfNames"
+	PosixGroup   = "posixGroup"
+)
+
+// The lowest gid_number_min allowed, keeping new posixGroups clear of root
+// and the system groups below it.
+const minGIDNumber = 1000
+
+// LDAPOptions configures where and how an LDAP sink writes groups.
+type LDAPOptions struct {
+	URL          string `mapstructure:"url"`
+	BindDN       string `mapstructure:"bind_dn"`
+	BindPassword string `mapstructure:"bind_password"`
+
+	// Read the bind password from this file instead, such as a mounted secret.
+	BindPasswordFile string `mapstructure:"bind_password_file"`
+
+	// Groups are written as cn=<name>,<BaseDN>.
+	BaseDN string `mapstructure:"base_dn"`
+
+	// Either groupOfNames, whose members are DNs, or posixGroup, whose
+	// members are user names.
+	ObjectClass string `mapstructure:"object_class"`
+
+	// Builds a member's DN from their user name for groupOfNames, e.g.
+	// uid=%s,ou=People,dc=example,dc=org.
+	UserDNTemplate string `mapstructure:"user_dn_template"`
+
+	// The lowest gidNumber given to new posixGroups, which must be at least
+	// 1000.
+	GIDNumberMin int `mapstructure:"gid_number_min"`
+}
+
+func (o *LDAPOptions) Validate() error {
+	if o.URL == "" || o.BaseDN == "" {
+		return errors.New("url and base_dn must be set")
+	}
+	if u, err := url.Parse(o.URL); err != nil {
+		return errors.Wrap(err, "url is invalid")
+	} else if u.Scheme != "ldap" && u.Scheme != "ldaps" && u.Scheme != "ldapi" {
+		return errors.Errorf("url must use ldap, ldaps or ldapi, not %s", u.Scheme)
+	}
+	if _, err := ldap.ParseDN(o.BaseDN); err != nil {
+		return errors.Wrap(err, "base_dn is invalid")
+	}
+
+	switch o.ObjectClass {
+	case GroupOfNames:
+		if strings.Count(o.UserDNTemplate, "%s") != 1 {
+			return errors.New("user_dn_template must contain %s exactly once for groupOfNames")
+		}
+	case PosixGroup:
+		if o.GIDNumberMin < minGIDNumber {
+			return errors.Errorf("gid_number_min must be at least %d for posixGroup", minGIDNumber)
+		}
+	default:
+		return errors.Errorf("object_class must be %s or %s", GroupOfNames, PosixGroup)
+	}
+	return nil
+}
+
+// LDAP writes groups to an LDAP directory.
+type LDAP struct {
+	Options LDAPOptions
+
+	// How long connecting and each request may take, or 0 for no limit.
+	Timeout time.Duration
+
+	// Opens a connection to the directory. Replace this to run against a
+	// stand-in directory rather than a server.
+	Dial func() (ldap.Client, error)
+
+	// Serializes creating posixGroups, so that groups created at once, such
+	// as by a crawl's workers, aren't given the same gidNumber.
+	createMu sync.Mutex
+}
+
+func NewLDAP(options LDAPOptions, timeout time.Duration) *LDAP {
+	return &LDAP{
+		Options: options,
+		Timeout: timeout,
+		Dial: func() (ldap.Client, error) {
+			return ldap.DialURL(options.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+		},
+	}
+}
+
+// Open a bound connection, which the caller must close.
+func (l *LDAP) conn() (ldap.Client, error) {
+	c, err := l.Dial()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed connecting to %s", l.Options.URL)
+	}
+	if l.Timeout > 0 {
+		c.SetTimeout(l.Timeout)
+	}
+
+	if l.Options.BindDN != "" {
+		if err = c.Bind(l.Options.BindDN, l.Options.BindPassword); err != nil {
+			c.Close()
+			return nil, errors.Wrapf(err, "Failed binding to %s as %s", l.Options.URL, l.Options.BindDN)
+		}
+	}
+	return c, nil
+}
+
+func (l *LDAP) groupDN(name string) string {
+	return fmt.Sprintf("cn=%s,%s", ldap.EscapeDN(name), l.Options.BaseDN)
+}
+
+func (l *LDAP) userDN(user string) string {
+	return fmt.Sprintf(l.Options.UserDNTemplate, ldap.EscapeDN(user))
+}
+
+// groupOfNames must have at least one member, so empty groups get the bind DN.
+func (l *LDAP) placeholderDN() string {
+	if l.Options.BindDN != "" {
+		return l.Options.BindDN
+	}
+	return l.Options.BaseDN
+}
+
+func (l *LDAP) memberAttribute() string {
+	if l.Options.ObjectClass == PosixGroup {
+		return "memberUid"
+	}
+	return "member"
+}
+
+// The attribute values for a list of members. Servers reject repeated
+// values, so each member is listed once.
+func (l *LDAP) memberValues(members []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, m := range members {
+		if !seen[m] {
+			seen[m] = true
+			unique = append(unique, m)
+		}
+	}
+
+	if l.Options.ObjectClass == PosixGroup {
+		return unique
+	}
+
+	if len(unique) == 0 {
+		return []string{l.placeholderDN()}
+	}
+	var dns []string
+	for _, m := range unique {
+		dns = append(dns, l.userDN(m))
+	}
+	return dns
+}
+
+// The user name in a member DN, taken from its first RDN.
+func memberName(dn string) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed parsing member DN %s", dn)
+	}
+	if len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return "", errors.Errorf("Member DN %s is empty", dn)
+	}
+	return parsed.RDNs[0].Attributes[0].Value, nil
+}
+
+// Returned unwrapped, since restutils.GetStatusCode doesn't look through wrapping.
+func notFound(name string) error {
+	return restutils.NewHTTPError(404, fmt.Sprintf("LDAP group %s does not exist", name))
+}
+
+func (l *LDAP) Check(ctx context.Context) error {
+	c, err := l.conn()
+	if err != nil {
+		return err
+	}
+	c.Close()
+	return nil
+}
+
+func (l *LDAP) ListGroupMembers(ctx context.Context, name string) ([]string, error) {
+	_, span := otel.Tracer(otelName).Start(ctx, "ListGroupMembers")
+	defer span.End()
+
+	c, err := l.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	attr := l.memberAttribute()
+	res, err := c.Search(ldap.NewSearchRequest(
+		l.groupDN(name), ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{attr}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, notFound(name)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed fetching LDAP group %s", name)
+	}
+	if len(res.Entries) == 0 {
+		return nil, notFound(name)
+	}
+
+	values := res.Entries[0].GetAttributeValues(attr)
+	if l.Options.ObjectClass == PosixGroup {
+		return values, nil
+	}
+
+	var members []string
+	for _, dn := range values {
+		if strings.EqualFold(dn, l.placeholderDN()) {
+			continue
+		}
+		m, err := memberName(dn)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// The gidNumber for a new posixGroup, one more than the highest in use.
+func (l *LDAP) nextGIDNumber(c ldap.Client) (int, error) {
+	res, err := c.Search(ldap.NewSearchRequest(
+		l.Options.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=posixGroup)", []string{"gidNumber"}, nil,
+	))
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed listing gidNumbers in use")
+	}
+
+	next := l.Options.GIDNumberMin
+	for _, e := range res.Entries {
+		gid, err := strconv.Atoi(e.GetAttributeValue("gidNumber"))
+		if err == nil && gid >= next {
+			next = gid + 1
+		}
+	}
+	return next, nil
+}
+
+func (l *LDAP) CreateGroup(ctx context.Context, name string) error {
+	_, span := otel.Tracer(otelName).Start(ctx, "CreateGroup")
+	defer span.End()
+
+	c, err := l.conn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	req := ldap.NewAddRequest(l.groupDN(name), nil)
+	req.Attribute("objectClass", []string{"top", l.Options.ObjectClass})
+	req.Attribute("cn", []string{name})
+
+	if l.Options.ObjectClass == PosixGroup {
+		l.createMu.Lock()
+		defer l.createMu.Unlock()
+
+		gid, err := l.nextGIDNumber(c)
+		if err != nil {
+			return err
+		}
+		req.Attribute("gidNumber", []string{strconv.Itoa(gid)})
+	} else {
+		req.Attribute("member", l.memberValues(nil))
+	}
+
+	if err = c.Add(req); err != nil {
+		return errors.Wrapf(err, "Failed creating LDAP group %s", name)
+	}
+	return nil
+}
+
+func (l *LDAP) UpdateGroupMembers(ctx context.Context, name string, members []string) error {
+	_, span := otel.Tracer(otelName).Start(ctx, "UpdateGroupMembers")
+	defer span.End()
+
+	c, err := l.conn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	req := ldap.NewModifyRequest(l.groupDN(name), nil)
+	req.Replace(l.memberAttribute(), l.memberValues(members))
+
+	err = c.Modify(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return notFound(name)
+	} else if err != nil {
+		return errors.Wrapf(err, "Failed updating LDAP group %s with %d members", name, len(members))
+	}
+	return nil
+}
+
+func (l *LDAP) DeleteGroup(ctx context.Context, name string) error {
+	_, span := otel.Tracer(otelName).Start(ctx, "DeleteGroup")
+	defer span.End()
+
+	c, err := l.conn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.Del(ldap.NewDelRequest(l.groupDN(name), nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return notFound(name)
+	} else if err != nil {
+		return errors.Wrapf(err, "Failed deleting LDAP group %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+// fakeDirectory is an in-memory stand-in for an LDAP server, holding entries
+// by lowercased DN.
+type fakeDirectory struct {
+	mu      sync.Mutex
+	entries map[string]map[string][]string
+	binds   []string
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{entries: make(map[string]map[string][]string)}
+}
+
+func (d *fakeDirectory) attribute(dn, attr string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.entries[strings.ToLower(dn)][attr]
+}
+
+// fakeConn is a connection to a fakeDirectory. Only the operations the sink
+// uses are implemented; anything else panics.
+type fakeConn struct {
+	ldap.Client
+	dir *fakeDirectory
+}
+
+func noSuchObject(dn string) error {
+	return ldap.NewError(ldap.LDAPResultNoSuchObject, errors.Errorf("%s does not exist", dn))
+}
+
+// Like a real server, reject an attribute that repeats a value.
+func checkValues(attr string, vals []string) error {
+	seen := make(map[string]bool)
+	for _, v := range vals {
+		if seen[v] {
+			return ldap.NewError(ldap.LDAPResultAttributeOrValueExists, errors.Errorf("%s has the value %s more than once", attr, v))
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error             { return nil }
+func (c *fakeConn) SetTimeout(time.Duration) {}
+
+func (c *fakeConn) Bind(username, password string) error {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+	c.dir.binds = append(c.dir.binds, username)
+	return nil
+}
+
+func (c *fakeConn) Add(req *ldap.AddRequest) error {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+
+	dn := strings.ToLower(req.DN)
+	if _, ok := c.dir.entries[dn]; ok {
+		return ldap.NewError(ldap.LDAPResultEntryAlreadyExists, errors.Errorf("%s already exists", req.DN))
+	}
+	attrs := make(map[string][]string)
+	for _, a := range req.Attributes {
+		if err := checkValues(a.Type, a.Vals); err != nil {
+			return err
+		}
+		attrs[a.Type] = a.Vals
+	}
+	c.dir.entries[dn] = attrs
+	return nil
+}
+
+func (c *fakeConn) Del(req *ldap.DelRequest) error {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+
+	dn := strings.ToLower(req.DN)
+	if _, ok := c.dir.entries[dn]; !ok {
+		return noSuchObject(req.DN)
+	}
+	delete(c.dir.entries, dn)
+	return nil
+}
+
+func (c *fakeConn) Modify(req *ldap.ModifyRequest) error {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+
+	attrs, ok := c.dir.entries[strings.ToLower(req.DN)]
+	if !ok {
+		return noSuchObject(req.DN)
+	}
+	for _, change := range req.Changes {
+		if change.Operation != ldap.ReplaceAttribute {
+			panic("fakeConn only supports replacing attributes")
+		}
+		if err := checkValues(change.Modification.Type, change.Modification.Vals); err != nil {
+			return err
+		}
+	}
+	for _, change := range req.Changes {
+		attrs[change.Modification.Type] = change.Modification.Vals
+	}
+	return nil
+}
+
+// Search supports base searches and subtree searches with an (attr=value)
+// filter.
+func (c *fakeConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+
+	base := strings.ToLower(req.BaseDN)
+	res := &ldap.SearchResult{}
+
+	if req.Scope == ldap.ScopeBaseObject {
+		attrs, ok := c.dir.entries[base]
+		if !ok {
+			return nil, noSuchObject(req.BaseDN)
+		}
+		res.Entries = append(res.Entries, ldap.NewEntry(req.BaseDN, attrs))
+		return res, nil
+	}
+
+	attr, value, _ := strings.Cut(strings.Trim(req.Filter, "()"), "=")
+	for dn, attrs := range c.dir.entries {
+		if !strings.HasSuffix(dn, ","+base) {
+			continue
+		}
+		for _, v := range attrs[attr] {
+			if strings.EqualFold(v, value) {
+				res.Entries = append(res.Entries, ldap.NewEntry(dn, attrs))
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func newTestLDAP(objectClass string) (*LDAP, *fakeDirectory) {
+	dir := newFakeDirectory()
+	l := NewLDAP(LDAPOptions{
+		URL:            "ldap://ldap.example.org",
+		BindDN:         "cn=admin,dc=example,dc=org",
+		BindPassword:   "secret",
+		BaseDN:         "ou=Groups,dc=example,dc=org",
+		ObjectClass:    objectClass,
+		UserDNTemplate: "uid=%s,ou=People,dc=example,dc=org",
+		GIDNumberMin:   10000,
+	}, time.Second)
+	l.Dial = func() (ldap.Client, error) {
+		return &fakeConn{dir: dir}, nil
+	}
+	return l, dir
+}
+
+func listMembers(t *testing.T, l *LDAP, name string) []string {
+	t.Helper()
+	members, err := l.ListGroupMembers(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func TestLDAPGroupOfNames(t *testing.T) {
+	ctx := context.Background()
+	l, dir := newTestLDAP(GroupOfNames)
+	dn := "cn=course-bio101,ou=Groups,dc=example,dc=org"
+
+	if err := l.CreateGroup(ctx, "course-bio101"); err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.attribute(dn, "member"); !reflect.DeepEqual(got, []string{"cn=admin,dc=example,dc=org"}) {
+		t.Errorf("new group's members = %v, want the placeholder", got)
+	}
+	if got := listMembers(t, l, "course-bio101"); len(got) != 0 {
+		t.Errorf("new group lists members %v, want none", got)
+	}
+	if len(dir.binds) == 0 || dir.binds[0] != "cn=admin,dc=example,dc=org" {
+		t.Errorf("binds = %v, want the bind DN", dir.binds)
+	}
+
+	if err := l.UpdateGroupMembers(ctx, "course-bio101", []string{"bob", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"uid=bob,ou=People,dc=example,dc=org", "uid=alice,ou=People,dc=example,dc=org"}
+	if got := dir.attribute(dn, "member"); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+	if got := listMembers(t, l, "course-bio101"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Errorf("listed members = %v, want [alice bob]", got)
+	}
+
+	if err := l.UpdateGroupMembers(ctx, "course-bio101", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.attribute(dn, "member"); !reflect.DeepEqual(got, []string{"cn=admin,dc=example,dc=org"}) {
+		t.Errorf("emptied group's members = %v, want the placeholder", got)
+	}
+	if got := listMembers(t, l, "course-bio101"); len(got) != 0 {
+		t.Errorf("emptied group lists members %v, want none", got)
+	}
+
+	if err := l.DeleteGroup(ctx, "course-bio101"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.ListGroupMembers(ctx, "course-bio101"); restutils.GetStatusCode(err) != 404 {
+		t.Errorf("listing a deleted group = %v, want a 404", err)
+	}
+	if err := l.UpdateGroupMembers(ctx, "course-bio101", []string{"alice"}); restutils.GetStatusCode(err) != 404 {
+		t.Errorf("updating a deleted group = %v, want a 404", err)
+	}
+	if err := l.DeleteGroup(ctx, "course-bio101"); restutils.GetStatusCode(err) != 404 {
+		t.Errorf("deleting a deleted group = %v, want a 404", err)
+	}
+}
+
+func TestLDAPPosixGroup(t *testing.T) {
+	ctx := context.Background()
+	l, dir := newTestLDAP(PosixGroup)
+
+	for _, name := range []string{"course-bio101", "course-bio102"} {
+		if err := l.CreateGroup(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, gid := range map[string]string{"course-bio101": "10000", "course-bio102": "10001"} {
+		dn := "cn=" + name + ",ou=Groups,dc=example,dc=org"
+		if got := dir.attribute(dn, "gidNumber"); !reflect.DeepEqual(got, []string{gid}) {
+			t.Errorf("%s gidNumber = %v, want %s", name, got, gid)
+		}
+		if got := dir.attribute(dn, "memberUid"); len(got) != 0 {
+			t.Errorf("%s has members %v, want none", name, got)
+		}
+	}
+
+	if err := l.UpdateGroupMembers(ctx, "course-bio101", []string{"bob", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.attribute("cn=course-bio101,ou=Groups,dc=example,dc=org", "memberUid"); !reflect.DeepEqual(got, []string{"bob", "alice"}) {
+		t.Errorf("memberUid = %v, want [bob alice]", got)
+	}
+	if got := listMembers(t, l, "course-bio101"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Errorf("listed members = %v, want [alice bob]", got)
+	}
+
+	if err := l.DeleteGroup(ctx, "course-bio101"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateGroup(ctx, "course-bio103"); err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.attribute("cn=course-bio103,ou=Groups,dc=example,dc=org", "gidNumber"); !reflect.DeepEqual(got, []string{"10002"}) {
+		t.Errorf("gidNumber after a deletion = %v, want 10002", got)
+	}
+}
+
+func TestLDAPPosixGroupConcurrentCreates(t *testing.T) {
+	ctx := context.Background()
+	l, dir := newTestLDAP(PosixGroup)
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- l.CreateGroup(ctx, fmt.Sprintf("course-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		gid := dir.attribute(fmt.Sprintf("cn=course-%d,ou=Groups,dc=example,dc=org", i), "gidNumber")
+		if len(gid) != 1 || seen[gid[0]] {
+			t.Fatalf("course-%d has gidNumber %v, which isn't unique", i, gid)
+		}
+		seen[gid[0]] = true
+	}
+}
+
+func TestLDAPOptionsValidate(t *testing.T) {
+	valid := LDAPOptions{
+		URL:            "ldap://ldap.example.org",
+		BaseDN:         "ou=Groups,dc=example,dc=org",
+		ObjectClass:    GroupOfNames,
+		UserDNTemplate: "uid=%s,ou=People,dc=example,dc=org",
+	}
+
+	tests := []struct {
+		name   string
+		change func(o *LDAPOptions)
+		valid  bool
+	}{
+		{"groupOfNames", func(o *LDAPOptions) {}, true},
+		{"groupOfNames without a user DN template", func(o *LDAPOptions) { o.UserDNTemplate = "" }, false},
+		{"posixGroup", func(o *LDAPOptions) { o.ObjectClass = PosixGroup; o.GIDNumberMin = 10000 }, true},
+		{"posixGroup without gid_number_min", func(o *LDAPOptions) { o.ObjectClass = PosixGroup }, false},
+		{"posixGroup with a system gid_number_min", func(o *LDAPOptions) { o.ObjectClass = PosixGroup; o.GIDNumberMin = 100 }, false},
+		{"unknown object class", func(o *LDAPOptions) { o.ObjectClass = "group" }, false},
+		{"http URL", func(o *LDAPOptions) { o.URL = "http://ldap.example.org" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := valid
+			tt.change(&o)
+			if err := o.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLDAPRepeatedMembers(t *testing.T) {
+	ctx := context.Background()
+
+	for _, objectClass := range []string{GroupOfNames, PosixGroup} {
+		t.Run(objectClass, func(t *testing.T) {
+			l, _ := newTestLDAP(objectClass)
+
+			if err := l.CreateGroup(ctx, "course-bio101"); err != nil {
+				t.Fatal(err)
+			}
+			// A user in two subgroups is listed twice in the expanded membership.
+			if err := l.UpdateGroupMembers(ctx, "course-bio101", []string{"alice", "bob", "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := listMembers(t, l, "course-bio101"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+				t.Errorf("listed members = %v, want [alice bob]", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Package sink defines the places group memberships are propagated to.
+package sink
+
+import (
+	"context"
+	"net"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cyverse-de/group-propagator/logging"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "sink"})
+
+const otelName = "github.com/cyverse-de/group-propagator/sink"
+
+// Sink writes group memberships somewhere. Members are user names, and
+// methods return a restutils.HTTPError with a 404 status for groups that
+// don't exist, the same as the data-info client.
+type Sink interface {
+	// Check that the sink is reachable.
+	Check(ctx context.Context) error
+
+	ListGroupMembers(ctx context.Context, name string) ([]string, error)
+
+	// Create an empty group.
+	CreateGroup(ctx context.Context, name string) error
+
+	// Replace the members of a group.
+	UpdateGroupMembers(ctx context.Context, name string, members []string) error
+
+	DeleteGroup(ctx context.Context, name string) error
+}
+
+// Flusher is implemented by sinks that buffer changes rather than writing
+// each one as it's made.
+type Flusher interface {
+	// Write out any buffered changes.
+	Flush() error
+}
+
+// IsTransient reports whether an error from a sink might not happen again if
+// the call is retried: network errors and timeouts, 5xx responses, and LDAP
+// servers that are busy or unavailable. Anything else, such as a 4xx response
+// or a group the propagator refuses to change, fails the same way every time.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var httpErr *restutils.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode() >= 500
+	}
+
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		switch ldapErr.ResultCode {
+		case ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultServerDown, ldap.LDAPResultTimeout, ldap.LDAPResultTimeLimitExceeded:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
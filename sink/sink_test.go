@@ -0,0 +1,41 @@
+package sink
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"no error", nil, false},
+		{"server error", restutils.NewHTTPError(503, "unavailable"), true},
+		{"wrapped server error", errors.Wrap(restutils.NewHTTPError(500, "oops"), "Failed fetching existing group members"), true},
+		{"not found", restutils.NewHTTPError(404, "no such group"), false},
+		{"bad request", restutils.NewHTTPError(400, "bad name"), false},
+		{"connection refused", errors.Wrap(&url.Error{Op: "Get", URL: "http://data-info", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, "Failed requesting URL"), true},
+		{"deadline", errors.Wrap(context.DeadlineExceeded, "Failed requesting URL"), true},
+		{"LDAP network error", errors.Wrap(ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed")), "Failed connecting"), true},
+		{"LDAP server busy", ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")), true},
+		{"LDAP constraint violation", ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("bad member")), false},
+		{"LDAP bind refused", ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials")), false},
+		{"refused change", errors.New("iRODS group course already exists in default but wasn't created for Grouper group"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.transient {
+				t.Errorf("IsTransient(%v) = %t, want %t", tt.err, got, tt.transient)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	groupsBucket = []byte("groups")
+	heldBucket   = []byte("held")
+
+	// An index of iRODS group names to the keys of the groups propagated to them.
+	irodsNamesBucket = []byte("irods_names")
+)
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// Move records written before state was kept per target, which are keyed by
+// bare group IDs, to the default target.
+func migrateToTargets(tx *bolt.Tx) (bool, error) {
+	migrated := false
+
+	for _, name := range [][]byte{groupsBucket, heldBucket} {
+		bucket := tx.Bucket(name)
+
+		var oldKeys [][]byte
+		err := bucket.ForEach(func(k, _ []byte) error {
+			if !strings.Contains(string(k), "/") {
+				oldKeys = append(oldKeys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+
+		for _, k := range oldKeys {
+			var record map[string]any
+			if err = json.Unmarshal(bucket.Get(k), &record); err != nil {
+				return false, err
+			}
+			record["target"] = DefaultTarget
+
+			v, err := json.Marshal(record)
+			if err != nil {
+				return false, err
+			}
+			if err = bucket.Put([]byte(key(DefaultTarget, string(k))), v); err != nil {
+				return false, err
+			}
+			if err = bucket.Delete(k); err != nil {
+				return false, err
+			}
+			migrated = true
+		}
+	}
+
+	return migrated, nil
+}
+
+// Rebuild the iRODS name index from scratch.
+func reindexIRODSNames(tx *bolt.Tx) error {
+	if tx.Bucket(irodsNamesBucket) != nil {
+		if err := tx.DeleteBucket(irodsNamesBucket); err != nil {
+			return err
+		}
+	}
+
+	names, err := tx.CreateBucket(irodsNamesBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(groupsBucket).ForEach(func(k, v []byte) error {
+		var s GroupState
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		if s.IRODSName == "" {
+			return nil
+		}
+		return names.Put([]byte(key(s.Target, s.IRODSName)), k)
+	})
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed opening state store %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{groupsBucket, heldBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		migrated, err := migrateToTargets(tx)
+		if err != nil {
+			return err
+		}
+
+		// Stores written before the index existed, or with keys that just
+		// changed, need it built.
+		if migrated || tx.Bucket(irodsNamesBucket) == nil {
+			return reindexIRODSNames(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Failed initializing state store")
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (b *BoltStore) GetGroupState(target, groupID string) (*GroupState, error) {
+	var s *GroupState
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(groupsBucket).Get([]byte(key(target, groupID)))
+		if v == nil {
+			return nil
+		}
+		s = &GroupState{}
+		return json.Unmarshal(v, s)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading state for group %s in %s", groupID, target)
+	}
+	return s, nil
+}
+
+// Remove the index entry for a group's previous iRODS name, if it still
+// points at the group.
+func unindexIRODSName(tx *bolt.Tx, k []byte) error {
+	old := tx.Bucket(groupsBucket).Get(k)
+	if old == nil {
+		return nil
+	}
+
+	var s GroupState
+	if err := json.Unmarshal(old, &s); err != nil {
+		return err
+	}
+
+	names := tx.Bucket(irodsNamesBucket)
+	nameKey := []byte(key(s.Target, s.IRODSName))
+	if s.IRODSName != "" && string(names.Get(nameKey)) == string(k) {
+		return names.Delete(nameKey)
+	}
+	return nil
+}
+
+func (b *BoltStore) PutGroupState(state *GroupState) error {
+	v, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "Failed marshaling group state")
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(key(state.Target, state.GroupID))
+		if err := unindexIRODSName(tx, k); err != nil {
+			return err
+		}
+		if state.IRODSName != "" {
+			if err := tx.Bucket(irodsNamesBucket).Put([]byte(key(state.Target, state.IRODSName)), k); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(groupsBucket).Put(k, v)
+	})
+	return errors.Wrapf(err, "Failed writing state for group %s in %s", state.GroupID, state.Target)
+}
+
+func (b *BoltStore) FindGroupByIRODSName(target, irodsName string) (*GroupState, error) {
+	var s *GroupState
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		k := tx.Bucket(irodsNamesBucket).Get([]byte(key(target, irodsName)))
+		if k == nil {
+			return nil
+		}
+		v := tx.Bucket(groupsBucket).Get(k)
+		if v == nil {
+			return nil
+		}
+		s = &GroupState{}
+		return json.Unmarshal(v, s)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed finding the group propagated to %s in %s", irodsName, target)
+	}
+	return s, nil
+}
+
+func (b *BoltStore) ListGroupStates() ([]GroupState, error) {
+	var states []GroupState
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsBucket).ForEach(func(_, v []byte) error {
+			var s GroupState
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			states = append(states, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed listing group states")
+	}
+	return states, nil
+}
+
+func (b *BoltStore) GetHeldChange(target, groupID string) (*HeldChange, error) {
+	var h *HeldChange
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(heldBucket).Get([]byte(key(target, groupID)))
+		if v == nil {
+			return nil
+		}
+		h = &HeldChange{}
+		return json.Unmarshal(v, h)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed reading held change for group %s in %s", groupID, target)
+	}
+	return h, nil
+}
+
+func (b *BoltStore) PutHeldChange(change *HeldChange) error {
+	v, err := json.Marshal(change)
+	if err != nil {
+		return errors.Wrap(err, "Failed marshaling held change")
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(heldBucket).Put([]byte(key(change.Target, change.GroupID)), v)
+	})
+	return errors.Wrapf(err, "Failed writing held change for group %s in %s", change.GroupID, change.Target)
+}
+
+func (b *BoltStore) DeleteHeldChange(target, groupID string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(heldBucket).Delete([]byte(key(target, groupID)))
+	})
+	return errors.Wrapf(err, "Failed deleting held change for group %s in %s", groupID, target)
+}
+
+func (b *BoltStore) ListHeldChanges() ([]HeldChange, error) {
+	var changes []HeldChange
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(heldBucket).ForEach(func(_, v []byte) error {
+			var h HeldChange
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			changes = append(changes, h)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed listing held changes")
+	}
+	return changes, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
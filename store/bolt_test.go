@@ -0,0 +1,140 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Write records the way stores did before state was kept per target: keyed
+// by bare group IDs, without the iRODS name index.
+func writeUntargetedStore(t *testing.T, path string) {
+	t.Helper()
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		groups, err := tx.CreateBucket(groupsBucket)
+		if err != nil {
+			return err
+		}
+		held, err := tx.CreateBucket(heldBucket)
+		if err != nil {
+			return err
+		}
+
+		if err = groups.Put([]byte("g1"), []byte(`{"group_id":"g1","group_name":"iplant:de:prod:a","irods_name":"@grouper-g1","last_result":"updated"}`)); err != nil {
+			return err
+		}
+		if err = groups.Put([]byte("g2"), []byte(`{"group_id":"g2","group_name":"iplant:de:prod:b","irods_name":"@grouper-g2","last_result":"held"}`)); err != nil {
+			return err
+		}
+		return held.Put([]byte("g2"), []byte(`{"group_id":"g2","irods_name":"@grouper-g2","removes":["alice"],"reason":"too many"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStoreMigratesToTargets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	writeUntargetedStore(t, path)
+
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := s.ListGroupStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("%d states after migration, want 2: %+v", len(states), states)
+	}
+	for _, state := range states {
+		if state.Target != DefaultTarget {
+			t.Errorf("state for %s has target %q, want %q", state.GroupID, state.Target, DefaultTarget)
+		}
+	}
+
+	state, err := s.GetGroupState(DefaultTarget, "g1")
+	if err != nil || state == nil || state.GroupName != "iplant:de:prod:a" || state.LastResult != ResultUpdated {
+		t.Errorf("GetGroupState(g1) = %+v, %v", state, err)
+	}
+
+	change, err := s.GetHeldChange(DefaultTarget, "g2")
+	if err != nil || change == nil || change.Target != DefaultTarget || change.Reason != "too many" {
+		t.Errorf("GetHeldChange(g2) = %+v, %v", change, err)
+	}
+
+	// The index is built from the migrated keys.
+	for _, id := range []string{"g1", "g2"} {
+		found, err := s.FindGroupByIRODSName(DefaultTarget, "@grouper-"+id)
+		if err != nil || found == nil || found.GroupID != id {
+			t.Errorf("FindGroupByIRODSName(@grouper-%s) = %+v, %v", id, found, err)
+		}
+	}
+
+	// Reopening doesn't migrate or reindex again, and keeps everything.
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if states, _ = s.ListGroupStates(); len(states) != 2 {
+		t.Errorf("%d states after reopening, want 2", len(states))
+	}
+	if found, _ := s.FindGroupByIRODSName(DefaultTarget, "@grouper-g1"); found == nil || found.GroupID != "g1" {
+		t.Errorf("FindGroupByIRODSName after reopening = %+v, want g1", found)
+	}
+}
+
+func TestReindexIRODSNames(t *testing.T) {
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, state := range []*GroupState{
+		{Target: DefaultTarget, GroupID: "g1", IRODSName: "a"},
+		{Target: "ldap", GroupID: "g1", IRODSName: "a"},
+		{Target: DefaultTarget, GroupID: "g2"},
+	} {
+		if err = s.PutGroupState(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leave a stale entry behind, as an index from an older layout might.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(irodsNamesBucket).Put([]byte(key(DefaultTarget, "stale")), []byte(key(DefaultTarget, "g2")))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.db.Update(reindexIRODSNames); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{DefaultTarget, "ldap"} {
+		found, err := s.FindGroupByIRODSName(target, "a")
+		if err != nil || found == nil || found.GroupID != "g1" || found.Target != target {
+			t.Errorf("FindGroupByIRODSName(%s, a) = %+v, %v, want g1", target, found, err)
+		}
+	}
+	if found, _ := s.FindGroupByIRODSName(DefaultTarget, "stale"); found != nil {
+		t.Errorf("stale index entry survived reindexing: %+v", found)
+	}
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+type MemoryStore struct {
+	mu     sync.RWMutex
+	groups map[string]GroupState
+	held   map[string]HeldChange
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		groups: make(map[string]GroupState),
+		held:   make(map[string]HeldChange),
+	}
+}
+
+func (m *MemoryStore) GetGroupState(target, groupID string) (*GroupState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.groups[key(target, groupID)]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *MemoryStore) PutGroupState(state *GroupState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.groups[key(state.Target, state.GroupID)] = *state
+	return nil
+}
+
+func (m *MemoryStore) FindGroupByIRODSName(target, irodsName string) (*GroupState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found *GroupState
+	for _, s := range m.groups {
+		if s.Target == target && s.IRODSName == irodsName && (found == nil || s.LastPropagated.After(found.LastPropagated)) {
+			s := s
+			found = &s
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryStore) ListGroupStates() ([]GroupState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	states := make([]GroupState, 0, len(m.groups))
+	for _, s := range m.groups {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return key(states[i].Target, states[i].GroupID) < key(states[j].Target, states[j].GroupID)
+	})
+	return states, nil
+}
+
+func (m *MemoryStore) GetHeldChange(target, groupID string) (*HeldChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h, ok := m.held[key(target, groupID)]
+	if !ok {
+		return nil, nil
+	}
+	return &h, nil
+}
+
+func (m *MemoryStore) PutHeldChange(change *HeldChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.held[key(change.Target, change.GroupID)] = *change
+	return nil
+}
+
+func (m *MemoryStore) DeleteHeldChange(target, groupID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.held, key(target, groupID))
+	return nil
+}
+
+func (m *MemoryStore) ListHeldChanges() ([]HeldChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	changes := make([]HeldChange, 0, len(m.held))
+	for _, h := range m.held {
+		changes = append(changes, h)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return key(changes[i].Target, changes[i].GroupID) < key(changes[j].Target, changes[j].GroupID)
+	})
+	return changes, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
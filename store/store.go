@@ -0,0 +1,111 @@
+package store
+
+import (
+	"time"
+
+	"github.com/cyverse-de/group-propagator/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "store"})
+
+// The target state is recorded under when only one is configured.
+const DefaultTarget = "default"
+
+type Result string
+
+const (
+	ResultUpdated   Result = "updated"
+	ResultUnchanged Result = "unchanged"
+	ResultDeleted   Result = "deleted"
+	ResultFailed    Result = "failed"
+	ResultHeld      Result = "held"
+	ResultSkipped   Result = "skipped"
+)
+
+// GroupState records the outcome of the most recent propagation of a Grouper
+// group to one target, such as an iRODS zone.
+type GroupState struct {
+	Target    string `json:"target"`
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+	IRODSName string `json:"irods_name"`
+
+	// The iRODS group this group was propagated to before being renamed,
+	// which is kept until migrate --delete-old deletes it.
+	RenamedFrom string `json:"renamed_from,omitempty"`
+
+	// A hash of the flattened, sorted member list last applied to iRODS.
+	MemberHash string `json:"member_hash"`
+
+	LastPropagated time.Time `json:"last_propagated"`
+	LastResult     Result    `json:"last_result"`
+	LastError      string    `json:"last_error,omitempty"`
+
+	// Why the last change was held for review instead of being applied.
+	HeldReason string `json:"held_reason,omitempty"`
+
+	// The number of consecutive failed propagations, reset on success.
+	ErrorCount int `json:"error_count"`
+}
+
+// HeldChange is a change to an iRODS group that was blocked by the safety
+// limits or because the group is sensitive, and is waiting for review. There
+// is at most one held change per group and target; a newer one replaces the older.
+type HeldChange struct {
+	Target    string `json:"target"`
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+	IRODSName string `json:"irods_name"`
+
+	Adds    []string `json:"adds"`
+	Removes []string `json:"removes"`
+	Delete  bool     `json:"delete"`
+
+	// The full membership the iRODS group will have if the change is approved.
+	Members []string `json:"members"`
+
+	Reason string    `json:"reason"`
+	HeldAt time.Time `json:"held_at"`
+}
+
+// Store persists propagation state between runs of the service. State and
+// held changes are kept separately for each target.
+type Store interface {
+	// Get the state for a group, returning nil if the group has never been
+	// propagated to the target.
+	GetGroupState(target, groupID string) (*GroupState, error)
+	PutGroupState(state *GroupState) error
+
+	// List the state of every group for every target.
+	ListGroupStates() ([]GroupState, error)
+
+	// Find the group most recently propagated to an iRODS group name in a
+	// target, returning nil if there is none.
+	FindGroupByIRODSName(target, irodsName string) (*GroupState, error)
+
+	// Get the held change for a group and target, returning nil if there isn't one.
+	GetHeldChange(target, groupID string) (*HeldChange, error)
+	PutHeldChange(change *HeldChange) error
+	DeleteHeldChange(target, groupID string) error
+	ListHeldChanges() ([]HeldChange, error)
+
+	Close() error
+}
+
+// key identifies a group or iRODS name within a target.
+func key(target, id string) string {
+	return target + "/" + id
+}
+
+// New returns a file-backed store at the given path, or an in-memory store
+// if the path is empty. Only one process can have the file open at a time, so
+// every instance of the service sharing state means running a single
+// instance with the file on a persistent volume.
+func New(path string) (Store, error) {
+	if path == "" {
+		log.Warn("No state store path configured, propagation state and held changes will not persist across restarts")
+		return NewMemoryStore(), nil
+	}
+	return NewBoltStore(path)
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Run the same checks against each store implementation.
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		fn(t, s)
+	})
+}
+
+func TestGroupStates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if state, err := s.GetGroupState("default", "g1"); err != nil || state != nil {
+			t.Fatalf("GetGroupState of an unknown group = %+v, %v, want nil", state, err)
+		}
+
+		put := []GroupState{
+			{Target: "default", GroupID: "g1", GroupName: "iplant:de:prod:a", IRODSName: "@grouper-g1", LastResult: ResultUpdated},
+			{Target: "default", GroupID: "g2", GroupName: "iplant:de:prod:b", IRODSName: "@grouper-g2", LastResult: ResultFailed, ErrorCount: 2},
+			{Target: "ldap", GroupID: "g1", GroupName: "iplant:de:prod:a", IRODSName: "a", LastResult: ResultHeld, HeldReason: "sensitive"},
+		}
+		for i := range put {
+			if err := s.PutGroupState(&put[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, want := range put {
+			got, err := s.GetGroupState(want.Target, want.GroupID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || *got != want {
+				t.Errorf("GetGroupState(%s, %s) = %+v, want %+v", want.Target, want.GroupID, got, want)
+			}
+		}
+
+		states, err := s.ListGroupStates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(states) != len(put) {
+			t.Errorf("ListGroupStates returned %d states, want %d", len(states), len(put))
+		}
+	})
+}
+
+func TestFindGroupByIRODSName(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		now := time.Now()
+		g1 := &GroupState{Target: "default", GroupID: "g1", IRODSName: "course", LastPropagated: now}
+		if err := s.PutGroupState(g1); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := s.FindGroupByIRODSName("default", "course")
+		if err != nil || found == nil || found.GroupID != "g1" {
+			t.Fatalf("FindGroupByIRODSName = %+v, %v, want g1", found, err)
+		}
+		if found, _ := s.FindGroupByIRODSName("ldap", "course"); found != nil {
+			t.Errorf("found %s in the wrong target", found.GroupID)
+		}
+
+		// Another group propagated to the same name more recently takes it over.
+		g2 := &GroupState{Target: "default", GroupID: "g2", IRODSName: "course", LastPropagated: now.Add(time.Second)}
+		if err = s.PutGroupState(g2); err != nil {
+			t.Fatal(err)
+		}
+		if found, _ = s.FindGroupByIRODSName("default", "course"); found == nil || found.GroupID != "g2" {
+			t.Errorf("FindGroupByIRODSName after a second group = %+v, want g2", found)
+		}
+
+		// Renaming a group releases its old name.
+		g2.IRODSName = "course-renamed"
+		g2.LastPropagated = now.Add(2 * time.Second)
+		if err = s.PutGroupState(g2); err != nil {
+			t.Fatal(err)
+		}
+		if found, _ = s.FindGroupByIRODSName("default", "course-renamed"); found == nil || found.GroupID != "g2" {
+			t.Errorf("FindGroupByIRODSName of the new name = %+v, want g2", found)
+		}
+		if found, _ = s.FindGroupByIRODSName("default", "course"); found != nil && found.GroupID == "g2" {
+			t.Error("renamed group is still found by its old name")
+		}
+	})
+}
+
+func TestHeldChanges(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if change, err := s.GetHeldChange("default", "g1"); err != nil || change != nil {
+			t.Fatalf("GetHeldChange of an unknown group = %+v, %v, want nil", change, err)
+		}
+
+		change := &HeldChange{Target: "default", GroupID: "g1", IRODSName: "@grouper-g1", Removes: []string{"alice"}, Members: []string{"bob"}, Reason: "too many"}
+		if err := s.PutHeldChange(change); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutHeldChange(&HeldChange{Target: "ldap", GroupID: "g1", Delete: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.GetHeldChange("default", "g1")
+		if err != nil || got == nil || got.Reason != "too many" || len(got.Members) != 1 || got.Members[0] != "bob" {
+			t.Errorf("GetHeldChange = %+v, %v, want %+v", got, err, change)
+		}
+
+		if err = s.DeleteHeldChange("default", "g1"); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = s.GetHeldChange("default", "g1"); got != nil {
+			t.Error("held change wasn't deleted")
+		}
+
+		changes, err := s.ListHeldChanges()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || changes[0].Target != "ldap" || !changes[0].Delete {
+			t.Errorf("ListHeldChanges = %+v, want only the ldap deletion", changes)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/cyverse-de/group-propagator/client/datainfo"
+	"github.com/cyverse-de/group-propagator/config"
+	"github.com/cyverse-de/group-propagator/sink"
+)
+
+// Target is somewhere groups are propagated to, such as data-info for one
+// iRODS zone or grid, an LDAP directory, or snapshot files. Each target's state is tracked
+// separately, so one being unavailable doesn't hold up the others.
+type Target struct {
+	Name string
+	Sink sink.Sink
+
+	// How many more times to try a failed propagation, and how long to wait
+	// between tries.
+	Retries    int
+	RetryDelay time.Duration
+}
+
+func NewTargets(cfg *config.Config) []*Target {
+	var targets []*Target
+	for _, t := range cfg.Targets {
+		var s sink.Sink
+		switch t.Type {
+		case config.TargetLDAP:
+			s = sink.NewLDAP(t.LDAP, cfg.TargetTimeout)
+		case config.TargetFile:
+			s = sink.NewFile(t.File)
+		default:
+			s = sink.NewDataInfo(datainfo.NewDataInfoClient(t.Base, t.IRODSUser, cfg.TargetTimeout))
+		}
+
+		targets = append(targets, &Target{
+			Name:       t.Name,
+			Sink:       s,
+			Retries:    cfg.TargetRetries,
+			RetryDelay: cfg.TargetRetryDelay,
+		})
+	}
+	return targets
+}
+
+// flushTargets writes out whatever the targets' sinks have buffered,
+// returning the last error.
+func flushTargets(targets []*Target) error {
+	var lastErr error
+	for _, t := range targets {
+		if f, ok := t.Sink.(sink.Flusher); ok {
+			if err := f.Flush(); err != nil {
+				lastErr = errors.Wrapf(err, "Failed flushing target %s", t.Name)
+				log.Error(lastErr)
+			}
+		}
+	}
+	return lastErr
+}
+
+// retry calls fn until it succeeds, fails with an error that retrying won't
+// fix, or the target's retries are used up, returning the last error.
+func (t *Target) retry(ctx context.Context, fn func() error) error {
+	err := fn()
+	for i := 0; sink.IsTransient(err) && i < t.Retries; i++ {
+		log.Warnf("Retrying after error in target %s: %s", t.Name, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(t.RetryDelay):
+		}
+
+		err = fn()
+	}
+	return err
+}
+
+// TargetError reports the targets a group couldn't be propagated to. The
+// failures are recorded in the group's state for each target, which the next
+// crawl retries first, so there's no need to redeliver the request and hold up
+// the targets that succeeded.
+type TargetError struct {
+	GroupID  string
+	Failures map[string]error
+}
+
+func (e *TargetError) Error() string {
+	names := make([]string, 0, len(e.Failures))
+	for name := range e.Failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e.Failures[name])
+	}
+	return fmt.Sprintf("Failed propagating group %s to %s", e.GroupID, strings.Join(msgs, "; "))
+}
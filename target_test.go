@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/go-mod/restutils"
+	"github.com/pkg/errors"
+)
+
+func TestTargetRetry(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{"success", nil, 1},
+		{"transient", restutils.NewHTTPError(503, "unavailable"), 3},
+		{"not found", restutils.NewHTTPError(404, "no such group"), 1},
+		{"refused", errors.New("iRODS group course is already used by another Grouper group"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &Target{Name: "default", Retries: 2}
+
+			calls := 0
+			err := target.retry(context.Background(), func() error {
+				calls++
+				return tt.err
+			})
+			if err != tt.err {
+				t.Errorf("retry returned %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}